@@ -0,0 +1,175 @@
+package handa
+
+import (
+  "context"
+  "fmt"
+  "strings"
+)
+
+// DropColumn drops column and, for a long string column, its hash column. Indexes on them are dropped first.
+// Nothing is done if the column does not exist.
+func (self *Handa) DropColumn(table string, column string) error {
+  return self.DropColumnContext(context.Background(), table, column)
+}
+
+func (self *Handa) DropColumnContext(ctx context.Context, table string, column string) error {
+  if column == "serial" {
+    return fmt.Errorf("can not drop column serial of table %s", table)
+  }
+  if err := validateIdentifier("table", table); err != nil {
+    return err
+  }
+  if err := validateIdentifier("column", column); err != nil {
+    return err
+  }
+  if tableInfo, err := self.loadTable(table); err != nil || tableInfo == nil {
+    return err
+  }
+  _, err := self.requestColumnDDL(ctx, table, columnDDLReq{column: column, drop: true})
+  return err
+}
+
+// RenameColumn renames column and, for a long string column, its hash column. Indexes on them are renamed too.
+func (self *Handa) RenameColumn(table string, column string, newName string) error {
+  return self.RenameColumnContext(context.Background(), table, column, newName)
+}
+
+func (self *Handa) RenameColumnContext(ctx context.Context, table string, column string, newName string) error {
+  if column == "serial" || newName == "serial" {
+    return fmt.Errorf("can not rename column serial of table %s", table)
+  }
+  if err := validateIdentifier("table", table); err != nil {
+    return err
+  }
+  if err := validateIdentifier("column", column); err != nil {
+    return err
+  }
+  if err := validateNewIdentifier("column", newName); err != nil {
+    return err
+  }
+  tableInfo, err := self.loadTable(table)
+  if err != nil {
+    return err
+  }
+  if tableInfo == nil {
+    return fmt.Errorf("%w: %s", ErrNoTable, table)
+  }
+  _, err = self.requestColumnDDL(ctx, table, columnDDLReq{column: column, rename: newName})
+  return err
+}
+
+// DropIndex drops an index, named as in reads, like "a$b" or "a" + NonUniqueSuffix. Hash columns of the index are kept.
+// Nothing is done if the index does not exist.
+func (self *Handa) DropIndex(table string, index string) error {
+  return self.DropIndexContext(context.Background(), table, index)
+}
+
+func (self *Handa) DropIndexContext(ctx context.Context, table string, index string) error {
+  if err := validateIdentifier("table", table); err != nil {
+    return err
+  }
+  tableInfo, err := self.loadTable(table)
+  if err != nil || tableInfo == nil {
+    return err
+  }
+  if _, exists := tableInfo.index[index]; !exists { // named by columns, long string columns are indexed by hashes
+    columns, unique := splitIndex(index)
+    if err := validateIdentifiers("column", columns...); err != nil {
+      return err
+    }
+    for i, column := range columns {
+      if tableInfo.columnType[column] == ColTypeLongString {
+        columns[i] = "hash_" + column
+      }
+    }
+    index = strings.Join(columns, "$")
+    if !unique {
+      index += NonUniqueSuffix
+    }
+  }
+  if index == "serial" || index == "PRIMARY" {
+    return fmt.Errorf("can not drop primary key of table %s", table)
+  }
+  _, err = self.requestIndexDDL(ctx, table, indexDDLReq{index: index, drop: true})
+  return err
+}
+
+// DropTable drops table with all its rows. Nothing is done if the table does not exist.
+func (self *Handa) DropTable(table string) error {
+  return self.DropTableContext(context.Background(), table)
+}
+
+func (self *Handa) DropTableContext(ctx context.Context, table string) error {
+  if err := validateIdentifier("table", table); err != nil {
+    return err
+  }
+  _, err := self.requestTableDDL(ctx, tableDDLReq{table: table, drop: true})
+  return err
+}
+
+// dropColumn drops the column with its hash column and the indexes on them, called by the column DDL listener
+func (self *Handa) dropColumn(table string, tableInfo *TableInfo, column string) error {
+  hashColumn := "hash_" + column
+  indexes := tableInfo.indexesOf(column)
+  for index := range tableInfo.indexesOf(hashColumn) {
+    indexes[index] = nil
+  }
+  for index := range indexes {
+    if err := self.backend.DropIndex(table, index); err != nil {
+      return err
+    }
+  }
+  if tableInfo.isHashColumn(hashColumn) {
+    if err := self.backend.DropColumn(table, hashColumn); err != nil {
+      return err
+    }
+  }
+  return self.backend.DropColumn(table, column)
+}
+
+// renameColumn renames the column with its hash column, and recreates the indexes on them with new names, called by the column DDL listener
+func (self *Handa) renameColumn(table string, tableInfo *TableInfo, column string, newName string) error {
+  if _, ok := tableInfo.columns[column]; !ok {
+    return fmt.Errorf("table %s has no column %s", table, column)
+  }
+  if _, exists := tableInfo.columns[newName]; exists {
+    return fmt.Errorf("table %s has column %s already", table, newName)
+  }
+  hashColumn := "hash_" + column
+  renames := map[string]string{column: newName}
+  if tableInfo.isHashColumn(hashColumn) {
+    renames[hashColumn] = "hash_" + newName
+  }
+  indexes := make(map[string]bool)
+  for c := range renames {
+    for index := range tableInfo.indexesOf(c) {
+      indexes[index] = tableInfo.index[index]
+    }
+  }
+  for index := range indexes {
+    if err := self.backend.DropIndex(table, index); err != nil {
+      return err
+    }
+  }
+  for c, name := range renames {
+    if err := self.backend.RenameColumn(table, c, name); err != nil {
+      return err
+    }
+  }
+  for index, unique := range indexes {
+    columns, _ := splitIndex(index)
+    for i, c := range columns {
+      if name, ok := renames[c]; ok {
+        columns[i] = name
+      }
+    }
+    newIndex := strings.Join(columns, "$")
+    if !unique {
+      newIndex += NonUniqueSuffix
+    }
+    if err := self.backend.CreateIndex(table, newIndex, columns, unique); err != nil {
+      return err
+    }
+  }
+  return nil
+}
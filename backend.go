@@ -0,0 +1,73 @@
+package handa
+
+import (
+  "context"
+  "time"
+
+  tdh "github.com/reusee/go-tdhsocket"
+)
+
+// Backend is the storage engine behind Handa.
+// Handa keeps the schema cache, schema-on-write and hash index logic, a Backend stores rows and runs DDL.
+// DDL methods are called one at a time per table.
+type Backend interface {
+  // Conn takes a connection for one cursor, waiting no longer than ctx allows
+  Conn(ctx context.Context) (BackendConn, error)
+
+  Tables() ([]string, error)
+  // LoadTable returns an error matching ErrNoTable if the table does not exist
+  LoadTable(table string) (*TableInfo, error)
+  CreateTable(table string) error
+  AddColumn(table string, column string, t int) error
+  CreateIndex(table string, index string, columns []string, unique bool) error
+  // ModifyColumn changes the type of an existing column to t, keeping its data
+  ModifyColumn(table string, column string, t int) error
+  DropIndex(table string, index string) error
+  DropColumn(table string, column string) error
+  // RenameColumn keeps the column definition, with attributes handa does not track like AUTO_INCREMENT and COMMENT
+  RenameColumn(table string, column string, newName string) error
+  DropTable(table string) error
+
+  Close() error
+}
+
+// DDLLocker is implemented by backends shared by processes. Handa holds the lock of a table while running DDL on it.
+type DDLLocker interface {
+  // LockDDL waits for the lock of table no longer than timeout, the returned function releases the lock
+  LockDDL(table string, timeout time.Duration) (unlock func(), err error)
+}
+
+// SchemaVersioner is implemented by backends able to tell cheaply which tables are changed.
+// A version is any string that changes when columns or indexes of the table change.
+type SchemaVersioner interface {
+  SchemaVersions() (map[string]string, error)
+}
+
+// BackendConn is used by a single cursor at a time.
+// Index names, keys, ops and filters follow tdh semantics:
+// an index is named by its columns joined with "$", followed by NonUniqueSuffix if not unique, and "serial" is the primary key.
+type BackendConn interface {
+  Get(table string, index string, fields []string,
+    keys [][]string, op uint8,
+    start uint32, limit uint32, filters []tdh.Filter) (rows [][][]byte, types []uint8, err error)
+  Insert(table string, index string, fields []string, values []string) error
+  Update(table string, index string, fields []string,
+    keys [][]string, op uint8,
+    start uint32, limit uint32, filters []tdh.Filter, values []string) (count int, change int, err error)
+  Delete(table string, index string, fields []string,
+    keys [][]string, op uint8,
+    start uint32, limit uint32, filters []tdh.Filter) (change int, err error)
+
+  // Batch makes later Insert, Update and Delete queued until Commit
+  Batch()
+  Commit() ([]Result, error)
+
+  // Release gives the connection back to the backend
+  Release()
+}
+
+// Upserter is implemented by connections able to insert a row or update the
+// existing one in a single statement. InsertUpdate and UpdateInsert use it when available.
+type Upserter interface {
+  Upsert(table string, index string, fields []string, values []string, updateFields []string) error
+}
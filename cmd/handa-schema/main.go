@@ -0,0 +1,135 @@
+// Command handa-schema dumps the schema handa sees in a database, and diffs it against another database or a schema file.
+//
+//   handa-schema -db foo dump                   CREATE TABLE statements, to seed new environments
+//   handa-schema -db foo -format json dump      JSON, usable as a schema file
+//   handa-schema -db foo diff bar               against database bar on the same server
+//   handa-schema -db foo diff user:pass@host:port/bar
+//   handa-schema -db foo diff schema.json       against a schema file
+//
+// diff prints one line per difference, prefixed by + if only in the target, - if only in the database, ~ if changed,
+// and exits with status 1 if any.
+package main
+
+import (
+  "context"
+  "flag"
+  "fmt"
+  "os"
+  "strings"
+
+  "github.com/reusee/handa"
+)
+
+var (
+  host = flag.String("host", "127.0.0.1", "mysql host")
+  port = flag.String("port", "3306", "mysql port")
+  user = flag.String("user", "root", "mysql user")
+  password = flag.String("password", "", "mysql password")
+  database = flag.String("db", "", "database")
+  format = flag.String("format", "sql", "dump format, sql or json")
+)
+
+func main() {
+  flag.Usage = func() {
+    fmt.Fprintf(os.Stderr, "usage: %s [flags] dump | diff <database | user:password@host:port/database | file.json>\n", os.Args[0])
+    flag.PrintDefaults()
+  }
+  flag.Parse()
+  if *database == "" || flag.NArg() == 0 {
+    flag.Usage()
+    os.Exit(2)
+  }
+  config := handa.Config{
+    Host: *host,
+    Port: *port,
+    User: *user,
+    Password: *password,
+    Database: *database,
+  }
+  tables, err := load(config)
+  if err != nil {
+    fatal("%v", err)
+  }
+
+  switch flag.Arg(0) {
+  case "dump":
+    if err := dump(os.Stdout, tables, *format); err != nil {
+      fatal("%v", err)
+    }
+  case "diff":
+    if flag.NArg() != 2 {
+      flag.Usage()
+      os.Exit(2)
+    }
+    target := flag.Arg(1)
+    var targetTables []Table
+    if _, err := os.Stat(target); err == nil {
+      targetTables, err = readFile(target)
+      if err != nil {
+        fatal("%v", err)
+      }
+    } else {
+      targetTables, err = load(parseTarget(config, target))
+      if err != nil {
+        fatal("%v", err)
+      }
+    }
+    if status := printDiff(os.Stdout, tables, targetTables); status != 0 {
+      os.Exit(status)
+    }
+  default:
+    flag.Usage()
+    os.Exit(2)
+  }
+}
+
+// load reads the schemas of all tables in the database
+func load(config handa.Config) ([]Table, error) {
+  config.Driver = handa.DriverSQL
+  h, err := handa.NewWithConfig(config)
+  if err != nil {
+    return nil, err
+  }
+  defer h.Close(context.Background())
+  names, err := h.LoadTables()
+  if err != nil {
+    return nil, err
+  }
+  var tables []Table
+  for _, name := range names {
+    if schema, ok := h.Table(name); ok {
+      tables = append(tables, newTable(schema))
+    }
+  }
+  return tables, nil
+}
+
+// parseTarget parses [user[:password]@][host[:port]]/database, missing parts are taken from config
+func parseTarget(config handa.Config, target string) handa.Config {
+  if i := strings.LastIndex(target, "/"); i >= 0 {
+    config.Database = target[i + 1:]
+    target = target[:i]
+  } else {
+    config.Database = target
+    return config
+  }
+  if i := strings.LastIndex(target, "@"); i >= 0 {
+    config.User = target[:i]
+    if j := strings.Index(config.User, ":"); j >= 0 {
+      config.User, config.Password = config.User[:j], config.User[j + 1:]
+    }
+    target = target[i + 1:]
+  }
+  if target != "" {
+    config.Host = target
+    if i := strings.LastIndex(target, ":"); i >= 0 {
+      config.Host, config.Port = target[:i], target[i + 1:]
+    }
+  }
+  return config
+}
+
+func fatal(format string, args ...interface{}) {
+  fmt.Fprintf(os.Stderr, format + "\n", args...)
+  os.Exit(2)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "os"
+  "reflect"
+  "sort"
+  "strings"
+
+  "github.com/reusee/handa"
+)
+
+// Table is the JSON form of handa.TableSchema, with column types by name
+type Table struct {
+  Name string `json:"name"`
+  Columns []Column `json:"columns"`
+  Indexes []Index `json:"indexes"`
+}
+
+type Column struct {
+  Name string `json:"name"`
+  Type string `json:"type"` // name of the ColType* constant
+  SQLType string `json:"sql_type,omitempty"` // as DESCRIBE shows, not compared if empty
+  Nullable bool `json:"nullable"`
+  Default *string `json:"default"`
+  HashColumn string `json:"hash_column,omitempty"`
+}
+
+type Index struct {
+  Name string `json:"name"`
+  Columns []string `json:"columns"`
+  Unique bool `json:"unique"`
+}
+
+func newTable(schema handa.TableSchema) Table {
+  table := Table{
+    Name: schema.Name,
+  }
+  for _, index := range schema.Indexes {
+    table.Indexes = append(table.Indexes, Index(index))
+  }
+  for _, column := range schema.Columns {
+    table.Columns = append(table.Columns, Column{
+      Name: column.Name,
+      Type: handa.ColTypeName(column.Type),
+      SQLType: column.SQLType,
+      Nullable: column.Nullable,
+      Default: column.Default,
+      HashColumn: column.HashColumn,
+    })
+  }
+  return table
+}
+
+// schema converts back for generating DDL
+func (self Table) schema() (handa.TableSchema, error) {
+  schema := handa.TableSchema{
+    Name: self.Name,
+  }
+  for _, index := range self.Indexes {
+    schema.Indexes = append(schema.Indexes, handa.IndexSchema(index))
+  }
+  for _, column := range self.Columns {
+    t := -1
+    for i := 0; i <= handa.ColTypeUnknown; i++ {
+      if handa.ColTypeName(i) == column.Type {
+        t = i
+      }
+    }
+    if t < 0 {
+      return schema, fmt.Errorf("table %s column %s: unknown type %s", self.Name, column.Name, column.Type)
+    }
+    schema.Columns = append(schema.Columns, handa.ColumnSchema{
+      ColumnInfo: handa.ColumnInfo{
+        Name: column.Name,
+        Type: t,
+        SQLType: column.SQLType,
+        Nullable: column.Nullable,
+        Default: column.Default,
+      },
+      HashColumn: column.HashColumn,
+    })
+  }
+  return schema, nil
+}
+
+func dump(w io.Writer, tables []Table, format string) error {
+  switch format {
+  case "json":
+    encoder := json.NewEncoder(w)
+    encoder.SetIndent("", "  ")
+    return encoder.Encode(tables)
+  case "sql":
+    for _, table := range tables {
+      schema, err := table.schema()
+      if err != nil {
+        return err
+      }
+      if _, err := fmt.Fprintf(w, "%s;\n\n", schema.CreateTable()); err != nil {
+        return err
+      }
+    }
+    return nil
+  }
+  return fmt.Errorf("unknown format %s", format)
+}
+
+func readFile(path string) ([]Table, error) {
+  content, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+  var tables []Table
+  if err := json.Unmarshal(content, &tables); err != nil {
+    return nil, fmt.Errorf("%s: %w", path, err)
+  }
+  return tables, nil
+}
+
+// printDiff prints the differences, and returns the exit status, 1 if any
+func printDiff(w io.Writer, tables []Table, target []Table) int {
+  lines := diff(tables, target)
+  for _, line := range lines {
+    fmt.Fprintln(w, line)
+  }
+  if len(lines) > 0 {
+    return 1
+  }
+  return 0
+}
+
+// diff lists differences from tables to target, sorted
+func diff(tables []Table, target []Table) []string {
+  var lines []string
+  from := make(map[string]Table)
+  for _, table := range tables {
+    from[table.Name] = table
+  }
+  to := make(map[string]Table)
+  for _, table := range target {
+    to[table.Name] = table
+  }
+  for name := range from {
+    if _, ok := to[name]; !ok {
+      lines = append(lines, "- table " + name)
+    }
+  }
+  for name, toTable := range to {
+    fromTable, ok := from[name]
+    if !ok {
+      lines = append(lines, "+ table " + name)
+      continue
+    }
+
+    fromColumns := make(map[string]Column)
+    for _, column := range fromTable.Columns {
+      fromColumns[column.Name] = column
+    }
+    toColumns := make(map[string]Column)
+    for _, column := range toTable.Columns {
+      toColumns[column.Name] = column
+      fromColumn, ok := fromColumns[column.Name]
+      if !ok {
+        lines = append(lines, fmt.Sprintf("+ column %s.%s %s", name, column.Name, column.describe()))
+      } else if !fromColumn.same(column) {
+        lines = append(lines, fmt.Sprintf("~ column %s.%s %s -> %s", name, column.Name, fromColumn.describe(), column.describe()))
+      }
+    }
+    for _, column := range fromTable.Columns {
+      if _, ok := toColumns[column.Name]; !ok {
+        lines = append(lines, fmt.Sprintf("- column %s.%s %s", name, column.Name, column.describe()))
+      }
+    }
+
+    fromIndexes := make(map[string]Index)
+    for _, index := range fromTable.Indexes {
+      fromIndexes[index.Name] = index
+    }
+    toIndexes := make(map[string]Index)
+    for _, index := range toTable.Indexes {
+      toIndexes[index.Name] = index
+      fromIndex, ok := fromIndexes[index.Name]
+      if !ok {
+        lines = append(lines, fmt.Sprintf("+ index %s.%s %s", name, index.Name, describeIndex(index)))
+      } else if !reflect.DeepEqual(fromIndex, index) {
+        lines = append(lines, fmt.Sprintf("~ index %s.%s %s -> %s", name, index.Name, describeIndex(fromIndex), describeIndex(index)))
+      }
+    }
+    for _, index := range fromTable.Indexes {
+      if _, ok := toIndexes[index.Name]; !ok {
+        lines = append(lines, fmt.Sprintf("- index %s.%s %s", name, index.Name, describeIndex(index)))
+      }
+    }
+  }
+  sort.Slice(lines, func(i, j int) bool { // by object, then sign
+    return lines[i][2:] < lines[j][2:] || lines[i][2:] == lines[j][2:] && lines[i] < lines[j]
+  })
+  return lines
+}
+
+func (self Column) same(other Column) bool {
+  if self.SQLType == "" || other.SQLType == "" {
+    self.SQLType, other.SQLType = "", ""
+  }
+  return reflect.DeepEqual(self, other)
+}
+
+func (self Column) describe() string {
+  ret := self.Type
+  if self.SQLType != "" {
+    ret += " " + self.SQLType
+  }
+  if !self.Nullable {
+    ret += " not null"
+  }
+  if self.Default != nil {
+    ret += fmt.Sprintf(" default %q", *self.Default)
+  }
+  if self.HashColumn != "" {
+    ret += " hashed by " + self.HashColumn
+  }
+  return ret
+}
+
+func describeIndex(index Index) string {
+  ret := "(" + strings.Join(index.Columns, ", ") + ")"
+  if index.Unique {
+    ret = "unique " + ret
+  }
+  return ret
+}
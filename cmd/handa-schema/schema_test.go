@@ -0,0 +1,167 @@
+package main
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+
+  "github.com/reusee/handa"
+)
+
+func TestParseTarget(t *testing.T) {
+  config := handa.Config{
+    Host: "127.0.0.1",
+    Port: "3306",
+    User: "root",
+    Password: "secret",
+    Database: "foo",
+  }
+  cases := []struct {
+    target string
+    host, port, user, password, database string
+  }{
+    {"bar", "127.0.0.1", "3306", "root", "secret", "bar"},
+    {"/bar", "127.0.0.1", "3306", "root", "secret", "bar"},
+    {"db.example.com/bar", "db.example.com", "3306", "root", "secret", "bar"},
+    {"db.example.com:3307/bar", "db.example.com", "3307", "root", "secret", "bar"},
+    {"reader@db.example.com/bar", "db.example.com", "3306", "reader", "secret", "bar"},
+    {"reader:p@ss@db.example.com:3307/bar", "db.example.com", "3307", "reader", "p@ss", "bar"},
+  }
+  for _, c := range cases {
+    got := parseTarget(config, c.target)
+    if got.Host != c.host || got.Port != c.port || got.User != c.user || got.Password != c.password || got.Database != c.database {
+      t.Fatalf("parse %s: got %+v", c.target, got)
+    }
+  }
+}
+
+func str(s string) *string {
+  return &s
+}
+
+func testTables() []Table {
+  return []Table{
+    {
+      Name: "foo",
+      Columns: []Column{
+        {Name: "serial", Type: "ColTypeUint", SQLType: "bigint(20) unsigned"},
+        {Name: "a", Type: "ColTypeInt", SQLType: "bigint(255)", Nullable: true, Default: str("0")},
+        {Name: "b", Type: "ColTypeLongString", SQLType: "longtext", Nullable: true, Default: str(""), HashColumn: "hash_b"},
+      },
+      Indexes: []Index{
+        {Name: "a$hash_b", Columns: []string{"a", "b"}, Unique: true},
+        {Name: "serial", Columns: []string{"serial"}, Unique: true},
+      },
+    },
+    {
+      Name: "bar",
+      Columns: []Column{
+        {Name: "serial", Type: "ColTypeUint", SQLType: "bigint(20) unsigned"},
+      },
+      Indexes: []Index{
+        {Name: "serial", Columns: []string{"serial"}, Unique: true},
+      },
+    },
+  }
+}
+
+func TestDiff(t *testing.T) {
+  var out bytes.Buffer
+  if status := printDiff(&out, testTables(), testTables()); status != 0 || out.Len() != 0 {
+    t.Fatal("same schemas", status, out.String())
+  }
+
+  target := testTables()
+  target[0].Columns[1].Type = "ColTypeDecimal"
+  target[0].Columns[1].SQLType = "decimal(65,30)"
+  target[0].Columns = append(target[0].Columns, Column{Name: "c", Type: "ColTypeString", Nullable: true})
+  target[0].Indexes[0].Unique = false
+  target[0].Indexes = append(target[0].Indexes, Index{Name: "c_nu", Columns: []string{"c"}})
+  target[1].Name = "baz"
+  expected := []string{
+    "~ column foo.a ColTypeInt bigint(255) default \"0\" -> ColTypeDecimal decimal(65,30) default \"0\"",
+    "+ column foo.c ColTypeString",
+    "~ index foo.a$hash_b unique (a, b) -> (a, b)",
+    "+ index foo.c_nu (c)",
+    "- table bar",
+    "+ table baz",
+  }
+  out.Reset()
+  if status := printDiff(&out, testTables(), target); status != 1 || out.String() != strings.Join(expected, "\n") + "\n" {
+    t.Fatal("diff", status, out.String())
+  }
+  if lines := diff(target, testTables()); len(lines) != len(expected) || lines[4] != "+ table bar" || lines[5] != "- table baz" {
+    t.Fatal("reversed", lines)
+  }
+
+  // SQL types are not compared if either is unknown
+  target = testTables()
+  target[0].Columns[1].SQLType = ""
+  if lines := diff(testTables(), target); len(lines) != 0 {
+    t.Fatal("empty sql type", lines)
+  }
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+  h, err := handa.NewWithConfig(handa.Config{
+    Driver: handa.DriverMemory,
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  if err := h.Insert("foo", "a, b", []interface{}{1, strings.Repeat("b", 300)}, "c", "c"); err != nil {
+    t.Fatal(err)
+  }
+  schema, ok := h.Table("foo")
+  if !ok {
+    t.Fatal("no table")
+  }
+  tables := []Table{newTable(schema)}
+
+  content, err := json.Marshal(tables)
+  if err != nil {
+    t.Fatal(err)
+  }
+  var decoded []Table
+  if err := json.Unmarshal(content, &decoded); err != nil {
+    t.Fatal(err)
+  }
+  if !reflect.DeepEqual(decoded, tables) {
+    t.Fatal("decoded", decoded)
+  }
+  converted, err := decoded[0].schema()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if converted.CreateTable() != schema.CreateTable() {
+    t.Fatal("create table", converted.CreateTable())
+  }
+  if !reflect.DeepEqual(newTable(converted), tables[0]) {
+    t.Fatal("converted", newTable(converted))
+  }
+
+  // through a schema file
+  var out bytes.Buffer
+  if err := dump(&out, tables, "json"); err != nil {
+    t.Fatal(err)
+  }
+  path := filepath.Join(t.TempDir(), "schema.json")
+  if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+    t.Fatal(err)
+  }
+  read, err := readFile(path)
+  if err != nil || !reflect.DeepEqual(read, tables) {
+    t.Fatal("read file", read, err)
+  }
+
+  decoded[0].Columns[0].Type = "ColTypeFoo"
+  if _, err := decoded[0].schema(); err == nil {
+    t.Fatal("unknown type")
+  }
+}
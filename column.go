@@ -0,0 +1,170 @@
+package handa
+
+import (
+  "math/big"
+  "regexp"
+  "strconv"
+  "strings"
+  "unicode/utf8"
+)
+
+// ColumnInfo describes a column as DESCRIBE shows it
+type ColumnInfo struct {
+  Name string
+  Type int // ColType*
+  SQLType string // as DESCRIBE shows, like bigint(20) unsigned
+  BaseType string // lower case MySQL type without length and attributes, like varchar
+  Length int // length or display width, 0 if not shown
+  Scale int // digits after the decimal point
+  Unsigned bool
+  Nullable bool
+  Default *string // nil if no default
+}
+
+var columnTypePattern = regexp.MustCompile(`^([a-z ]+?)\s*(?:\((\d+)(?:,\s*(\d+))?\))?((?:\s+[a-z]+)*)$`)
+
+// parseColumn parses a column type like "bigint(20) unsigned" or "decimal(10,2)"
+func parseColumn(name string, sqlType string, nullable bool, defaultValue *string) *ColumnInfo {
+  column := &ColumnInfo{
+    Name: name,
+    Nullable: nullable,
+    Default: defaultValue,
+  }
+  sqlType = strings.ToLower(strings.TrimSpace(sqlType))
+  column.SQLType = sqlType
+  match := columnTypePattern.FindStringSubmatch(sqlType)
+  if match == nil { // enum, set and others with arguments
+    column.BaseType = sqlType
+    if i := strings.Index(sqlType, "("); i > 0 {
+      column.BaseType = sqlType[:i]
+    }
+    column.Type = ColTypeUnknown
+    return column
+  }
+  column.BaseType = match[1]
+  column.Length, _ = strconv.Atoi(match[2])
+  column.Scale, _ = strconv.Atoi(match[3])
+  for _, attr := range strings.Fields(match[4]) {
+    if attr == "unsigned" {
+      column.Unsigned = true
+    }
+  }
+  column.Type = column.colType()
+  return column
+}
+
+var currentTimestampPattern = regexp.MustCompile(`(?i)^current_timestamp(\(\d*\))?$`)
+
+// definition returns the column definition as DESCRIBE shows it, like "varchar(255) NULL DEFAULT ''".
+// Attributes DESCRIBE shows as Extra, like AUTO_INCREMENT and ON UPDATE, are not included.
+func (self *ColumnInfo) definition(escape func(string) string) string {
+  definition := self.SQLType
+  if self.Nullable {
+    definition += " NULL"
+  } else {
+    definition += " NOT NULL"
+  }
+  if self.Default != nil {
+    if self.Type == ColTypeTime && currentTimestampPattern.MatchString(*self.Default) { // a function, not a string
+      definition += " DEFAULT " + *self.Default
+    } else {
+      definition += " DEFAULT '" + escape(*self.Default) + "'"
+    }
+  }
+  return definition
+}
+
+func (self *ColumnInfo) colType() int {
+  switch self.BaseType {
+  case "bool", "boolean":
+    return ColTypeBool
+  case "tinyint":
+    if self.Length == 1 {
+      return ColTypeBool
+    }
+    fallthrough
+  case "smallint", "mediumint", "int", "integer", "bigint":
+    if self.Unsigned {
+      return ColTypeUint
+    }
+    return ColTypeInt
+  case "double", "float", "real", "double precision":
+    return ColTypeFloat
+  case "decimal", "numeric":
+    return ColTypeDecimal
+  case "char":
+    if self.Length == 32 && strings.HasPrefix(self.Name, "hash_") {
+      return ColTypeHash
+    }
+    return ColTypeString
+  case "varchar":
+    return ColTypeString
+  case "tinytext", "text", "mediumtext", "longtext",
+    "tinyblob", "blob", "mediumblob", "longblob":
+    return ColTypeLongString
+  case "datetime", "timestamp":
+    return ColTypeTime
+  }
+  return ColTypeUnknown
+}
+
+// integerBits are the sizes of integer types, whatever their display width
+var integerBits = map[string]uint{
+  "tinyint": 8,
+  "smallint": 16,
+  "mediumint": 24,
+  "int": 32,
+  "integer": 32,
+  "bigint": 64,
+}
+
+// textBytes are the maximum lengths of text and blob types
+var textBytes = map[string]int{
+  "tinytext": 255,
+  "tinyblob": 255,
+  "text": 65535,
+  "blob": 65535,
+  "mediumtext": 16777215,
+  "mediumblob": 16777215,
+}
+
+// fits reports whether value, of type t, is stored in the column without truncation or overflow.
+// Columns narrower than their type in handa, like varchar(64), int(11) or text, may not hold all values of the type
+func (self *ColumnInfo) fits(t int, value string) bool {
+  switch self.Type {
+  case ColTypeString:
+    if t == ColTypeString && self.Length > 0 {
+      return utf8.RuneCountInString(value) <= self.Length
+    }
+  case ColTypeLongString:
+    if max, ok := textBytes[self.BaseType]; ok && t == ColTypeLongString {
+      return len(value) <= max
+    }
+  case ColTypeInt, ColTypeUint:
+    bits, ok := integerBits[self.BaseType]
+    if !ok || t != ColTypeInt && t != ColTypeUint {
+      break
+    }
+    i, ok := new(big.Int).SetString(value, 10)
+    if !ok {
+      break
+    }
+    min, max := new(big.Int), new(big.Int).Lsh(big.NewInt(1), bits)
+    if !self.Unsigned {
+      max.Rsh(max, 1)
+      min.Neg(max)
+    }
+    return i.Cmp(min) >= 0 && i.Cmp(max) < 0
+  case ColTypeDecimal:
+    if self.Length == 0 || t != ColTypeInt && t != ColTypeUint && t != ColTypeDecimal {
+      break
+    }
+    integer, fraction := strings.TrimPrefix(value, "-"), ""
+    if i := strings.Index(integer, "."); i >= 0 {
+      integer, fraction = integer[:i], integer[i + 1:]
+    }
+    integer = strings.TrimLeft(integer, "0")
+    return len(integer) <= self.Length - self.Scale && len(fraction) <= self.Scale
+  }
+  return true
+}
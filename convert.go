@@ -2,9 +2,25 @@ package handa
 
 import (
   "fmt"
+  "math/big"
+  "reflect"
+  "strconv"
+  "strings"
+  "time"
 )
 
-func convertToString(in interface{}) (ret string, t int) {
+// TimeFormat is how time.Time values are stored, in UTC
+const TimeFormat = "2006-01-02 15:04:05.000000"
+
+// decimalPrecision and decimalScale are the precision and scale of decimal columns
+const (
+  decimalPrecision = 65
+  decimalScale = 30
+)
+
+// convertToString converts a value to its stored form and column type.
+// Values are sent as strings, which cannot be NULL, so nil pointers are stored as the zero value of their element type.
+func convertToString(in interface{}) (ret string, t int, err error) {
   switch v := in.(type) {
   case bool:
     ret = "0"
@@ -28,22 +44,25 @@ func convertToString(in interface{}) (ret string, t int) {
     ret = fmt.Sprintf("%d", v)
     t = ColTypeInt
   case uint: 
+    ret = fmt.Sprintf("%d", v)
+    t = ColTypeUint
+  case uint8: // fits in signed columns
     ret = fmt.Sprintf("%d", v)
     t = ColTypeInt
-  case uint8:
+  case uint16: // fits in signed columns
     ret = fmt.Sprintf("%d", v)
     t = ColTypeInt
-  case uint32:
+  case uint32: // fits in signed columns
     ret = fmt.Sprintf("%d", v)
     t = ColTypeInt
   case uint64:
     ret = fmt.Sprintf("%d", v)
-    t = ColTypeInt
+    t = ColTypeUint
   case float32:
-    ret = fmt.Sprintf("%f", v)
+    ret = strconv.FormatFloat(float64(v), 'g', -1, 32)
     t = ColTypeFloat
   case float64:
-    ret = fmt.Sprintf("%f", v)
+    ret = strconv.FormatFloat(v, 'g', -1, 64)
     t = ColTypeFloat
   case string:
     ret = v
@@ -54,8 +73,82 @@ func convertToString(in interface{}) (ret string, t int) {
   case []byte:
     ret = string(v)
     t = ColTypeLongString
+  case time.Time:
+    ret = v.UTC().Format(TimeFormat)
+    t = ColTypeTime
+  case time.Duration: // nanoseconds
+    ret = fmt.Sprintf("%d", int64(v))
+    t = ColTypeInt
+  case *big.Int:
+    if v == nil {
+      v = new(big.Int)
+    }
+    ret = v.String()
+    t = ColTypeDecimal
+    if !inDecimalRange(ret) {
+      return "", 0, fmt.Errorf("%w: %s out of decimal range", ErrUnsupportedType, ret)
+    }
+  case *big.Rat:
+    if v == nil {
+      v = new(big.Rat)
+    }
+    ret = trimDecimal(v.FloatString(decimalScale))
+    t = ColTypeDecimal
+    if !inDecimalRange(ret) {
+      return "", 0, fmt.Errorf("%w: %s out of decimal range", ErrUnsupportedType, ret)
+    }
+  case *big.Float:
+    if v == nil {
+      v = new(big.Float)
+    }
+    if v.IsInf() {
+      return "", 0, fmt.Errorf("%w: %v %T", ErrUnsupportedType, v, in)
+    }
+    ret = trimDecimal(v.Text('f', decimalScale))
+    t = ColTypeDecimal
+    if !inDecimalRange(ret) {
+      return "", 0, fmt.Errorf("%w: %s out of decimal range", ErrUnsupportedType, ret)
+    }
   default:
-    panic("unknown type")
+    value := reflect.ValueOf(in)
+    if value.Kind() == reflect.Ptr {
+      if value.IsNil() {
+        return convertToString(reflect.Zero(value.Type().Elem()).Interface())
+      }
+      return convertToString(value.Elem().Interface())
+    }
+    return "", 0, fmt.Errorf("%w: %T", ErrUnsupportedType, in)
+  }
+  return ret, t, nil
+}
+
+// trimDecimal removes trailing zeros of the fraction
+func trimDecimal(s string) string {
+  if strings.Contains(s, ".") {
+    s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+  }
+  return s
+}
+
+// inDecimalRange reports whether the integer part of s fits in decimal columns
+func inDecimalRange(s string) bool {
+  s = strings.TrimPrefix(s, "-")
+  if i := strings.Index(s, "."); i >= 0 {
+    s = s[:i]
+  }
+  return len(s) <= decimalPrecision - decimalScale
+}
+
+// ParseTime parses a value read from a ColTypeTime column
+func ParseTime(s string) (time.Time, error) {
+  return time.ParseInLocation("2006-01-02 15:04:05.999999999", s, time.UTC)
+}
+
+// ParseDecimal parses a value read from a ColTypeDecimal column
+func ParseDecimal(s string) (*big.Rat, error) {
+  r, ok := new(big.Rat).SetString(s)
+  if !ok {
+    return nil, fmt.Errorf("invalid decimal %q", s)
   }
-  return ret, t
+  return r, nil
 }
@@ -1,6 +1,7 @@
 package handa
 
 import (
+  "context"
   tdh "github.com/reusee/go-tdhsocket"
   "regexp"
   "errors"
@@ -13,12 +14,102 @@ func init() {
 }
 
 type Cursor struct {
-  isValid bool // conn释放后，isValid为false，不能执行任何操作
+  isValid bool // 操作结束、归还conn前置为false，之后不能执行任何操作
+  err error // 创建失败的原因，如Handa已关闭
   handa *Handa
+  ctx context.Context
 
   isBatch bool
-  conn *tdh.Conn
+  batchChecks []func(err error) error // 每个排队的写操作一项，Commit时检查其结果的哈希冲突，nil为不检查
+  conn BackendConn
   end chan bool
+  inflight chan struct{} // 被ctx放弃但仍在进行的请求，conn须等其完成才能释放
+}
+
+// do runs fun against the cursor's connection. If the cursor's context is done
+// first, do returns ctx.Err() and the connection stays held until fun returns.
+func (self *Cursor) do(fun func()) error {
+  if err := self.ctx.Err(); err != nil {
+    return err
+  }
+  if self.ctx.Done() == nil {
+    fun()
+    return nil
+  }
+  done := make(chan struct{})
+  go func() {
+    fun()
+    close(done)
+  }()
+  select {
+  case <-done:
+    return nil
+  case <-self.ctx.Done():
+    self.inflight = done
+    return self.ctx.Err()
+  }
+}
+
+func (self *Cursor) get(table string, index string, fields []string,
+key [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter) (rows [][][]byte, types []uint8, err error) {
+  var r [][][]byte
+  var t []uint8
+  var e error
+  if err = self.do(func() {
+    r, t, e = self.conn.Get(table, index, fields,
+      key, op, start, limit, filters)
+  }); err != nil {
+    return
+  }
+  return r, t, e
+}
+
+func (self *Cursor) delete(table string, index string, fields []string,
+key [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter) (change int, err error) {
+  var c int
+  var e error
+  if err = self.do(func() {
+    c, e = self.conn.Delete(table, index, fields,
+      key, op, start, limit, filters)
+  }); err != nil {
+    return
+  }
+  return c, e
+}
+
+func (self *Cursor) update(table string, index string, fields []string,
+key [][]string, filters []tdh.Filter, values []string) (count int, change int, err error) {
+  var c, ch int
+  var e error
+  if err = self.do(func() {
+    c, ch, e = self.conn.Update(table, index, fields,
+      key, tdh.EQ, 0, 0, filters, values)
+  }); err != nil {
+    return
+  }
+  return c, ch, e
+}
+
+func (self *Cursor) insert(table string, index string, fields []string, values []string) (err error) {
+  var e error
+  if err = self.do(func() {
+    e = self.conn.Insert(table, index, fields, values)
+  }); err != nil {
+    return
+  }
+  return e
+}
+
+func (self *Cursor) upsert(upserter Upserter, table string, index string, fields []string, values []string, updateFields []string) (err error) {
+  var e error
+  if err = self.do(func() {
+    e = upserter.Upsert(table, index, fields, values, updateFields)
+  }); err != nil {
+    return
+  }
+  return e
 }
 
 // tdh
@@ -26,130 +117,215 @@ type Cursor struct {
 func (self *Cursor) TdhGet(table string, index string, fields []string,
 key [][]string, op uint8,
 start uint32, limit uint32, filters []tdh.Filter) (rows [][][]byte, types []uint8, err error) {
-  if !self.isValid { panic("Using an invalid cursor") }
-  if self.isBatch { panic("Not permit in batch mode") }
+  if self.err != nil { return nil, nil, self.err }
+  if !self.isValid { return nil, nil, ErrInvalidCursor }
+  if self.isBatch { return nil, nil, ErrBatchNotPermitted }
   if !self.isBatch { defer func() {
+    self.isValid = false
     self.end <- true
   }()}
 
-  rows, types, err = self.conn.Get(self.handa.dbname, table, index, fields,
-  key, op, start, limit, filters)
-  return
+  return self.get(table, index, fields, key, op, start, limit, filters)
 }
 
 func (self *Cursor) TdhDelete(table string, index string, fields []string,
 key [][]string, op uint8,
 start uint32, limit uint32, filters []tdh.Filter) (change int, err error) {
-  if !self.isValid { panic("Using an invalid cursor") }
-  if self.isBatch { panic("Not permit in batch mode") }
+  if self.err != nil { return 0, self.err }
+  if !self.isValid { return 0, ErrInvalidCursor }
+  if self.isBatch { return 0, ErrBatchNotPermitted }
   if !self.isBatch { defer func() {
+    self.isValid = false
     self.end <- true
   }()}
 
-  change, err = self.conn.Delete(self.handa.dbname, table, index, fields,
-  key, op, start, limit, filters)
-  return
+  return self.delete(table, index, fields, key, op, start, limit, filters)
 }
 
 // update and insert
 
 func (self *Cursor) Update(table string, index string, key interface{}, fieldList string, values ...interface{}) (count int, change int, err error) {
-  if !self.isValid { panic("Using an invalid cursor") }
+  if self.err != nil { return 0, 0, self.err }
+  if !self.isValid { return 0, 0, ErrInvalidCursor }
   if !self.isBatch { defer func() {
+    self.isValid = false
     self.end <- true
   }()}
-  dbIndex, _, dbKeys, _, _, dbFields, dbValues := self.handa.checkSchemaAndConvertData(table, index, key, fieldList, values...)
-  count, change, err = self.conn.Update(self.handa.dbname, table, dbIndex,
-    dbFields,
-    [][]string{dbKeys}, tdh.EQ,
-    0, 0, nil, dbValues)
+  dbIndex, dbIndexStrs, dbKeys, indexStrs, keyStrs, dbFields, dbValues, err := self.handa.checkSchemaAndConvertData(self.ctx, table, index, key, fieldList, values...)
+  if err != nil {
+    return
+  }
+  count, change, err = self.update(table, dbIndex, dbFields, [][]string{dbKeys}, self.handa.hashFilters(dbIndexStrs, indexStrs, keyStrs), dbValues)
+  if self.isBatch && err == nil { // results are in the order of requests
+    self.batchChecks = append(self.batchChecks, nil)
+  }
   return
 }
 
 func (self *Cursor) Insert(table string, index string, keys interface{}, fieldList string, values ...interface{}) (err error) {
-  if !self.isValid { panic("Using an invalid cursor") }
+  if self.err != nil { return self.err }
+  if !self.isValid { return ErrInvalidCursor }
   if !self.isBatch { defer func() {
+    self.isValid = false
     self.end <- true
   }()}
 
-  dbIndex, dbIndexStrs, dbKeys, indexStrs, keyStrs, dbFields, dbValues := self.handa.checkSchemaAndConvertData(table, index, keys, fieldList, values...)
-  err = self.conn.Insert(self.handa.dbname, table, dbIndex,
+  dbIndex, dbIndexStrs, dbKeys, indexStrs, keyStrs, dbFields, dbValues, err := self.handa.checkSchemaAndConvertData(self.ctx, table, index, keys, fieldList, values...)
+  if err != nil {
+    return
+  }
+  err = self.insert(table, dbIndex,
     append(append(dbFields, indexStrs...), dbIndexStrs...),
     append(append(dbValues, keyStrs...), dbKeys...))
-  return
+  if self.isBatch {
+    if err == nil { // checked on Commit
+      self.batchChecks = append(self.batchChecks, func(err error) error {
+        return self.checkHashCollision(table, dbIndex, dbIndexStrs, dbKeys, indexStrs, keyStrs, err)
+      })
+    }
+    return
+  }
+  return self.checkHashCollision(table, dbIndex, dbIndexStrs, dbKeys, indexStrs, keyStrs, err)
 }
 
 func (self *Cursor) UpdateInsert(table string, index string, key interface{}, fieldList string, values ...interface{}) (err error) {
-  if !self.isValid { panic("Using an invalid cursor") }
-  if self.isBatch { panic("Not permit in batch mode") }
+  if self.err != nil { return self.err }
+  if !self.isValid { return ErrInvalidCursor }
+  if self.isBatch { return ErrBatchNotPermitted }
   if !self.isBatch { defer func() {
+    self.isValid = false
     self.end <- true
   }()}
-  dbIndex, dbIndexStrs, dbKeys, indexStrs, keyStrs, dbFields, dbValues := self.handa.checkSchemaAndConvertData(table, index, key, fieldList, values...)
+  dbIndex, dbIndexStrs, dbKeys, indexStrs, keyStrs, dbFields, dbValues, err := self.handa.checkSchemaAndConvertData(self.ctx, table, index, key, fieldList, values...)
+  if err != nil {
+    return
+  }
+  hashFilters := self.handa.hashFilters(dbIndexStrs, indexStrs, keyStrs)
+  // an upsert would update the row of a colliding hash, so hashed keys go the way checking collisions
+  if upserter, ok := self.conn.(Upserter); ok && !hasHashedKey(dbIndexStrs, indexStrs) {
+    return self.upsert(upserter, table, dbIndex,
+      append(append(dbFields, indexStrs...), dbIndexStrs...),
+      append(append(dbValues, keyStrs...), dbKeys...), dbFields)
+  }
   var count int
-  count, _, err = self.conn.Update(self.handa.dbname, table, dbIndex,
-    dbFields,
-    [][]string{dbKeys}, tdh.EQ,
-    0, 0, nil, dbValues)
+  count, _, err = self.update(table, dbIndex, dbFields, [][]string{dbKeys}, hashFilters, dbValues)
   if err != nil {
     return
   }
   if count == 0 { // not exists, then insert
-    err = self.conn.Insert(self.handa.dbname, table, dbIndex,
+    err = self.insert(table, dbIndex,
     append(append(dbFields, indexStrs...), dbIndexStrs...),
     append(append(dbValues, keyStrs...), dbKeys...))
-    if err != nil {
-      e, _ := err.(*tdh.Error)
-      if e.ClientStatus == tdh.CLIENT_STATUS_DB_ERROR && e.ErrorCode == 121 {
-        err = nil
-      }
+    err = self.checkHashCollision(table, dbIndex, dbIndexStrs, dbKeys, indexStrs, keyStrs, err)
+    if errors.Is(err, ErrDuplicateKey) {
+      err = nil
     }
   }
   return
 }
 
 func (self *Cursor) InsertUpdate(table string, index string, key interface{}, fieldList string, values ...interface{}) (err error) {
-  if !self.isValid { panic("Using an invalid cursor") }
-  if self.isBatch { panic("Not permit in batch mode") }
+  if self.err != nil { return self.err }
+  if !self.isValid { return ErrInvalidCursor }
+  if self.isBatch { return ErrBatchNotPermitted }
   if !self.isBatch { defer func() {
+    self.isValid = false
     self.end <- true
   }()}
-  dbIndex, dbIndexStrs, dbKeys, indexStrs, keyStrs, dbFields, dbValues := self.handa.checkSchemaAndConvertData(table, index, key, fieldList, values...)
-  err = self.conn.Insert(self.handa.dbname, table, dbIndex,
+  dbIndex, dbIndexStrs, dbKeys, indexStrs, keyStrs, dbFields, dbValues, err := self.handa.checkSchemaAndConvertData(self.ctx, table, index, key, fieldList, values...)
+  if err != nil {
+    return
+  }
+  hashFilters := self.handa.hashFilters(dbIndexStrs, indexStrs, keyStrs)
+  // an upsert would update the row of a colliding hash, so hashed keys go the way checking collisions
+  if upserter, ok := self.conn.(Upserter); ok && !hasHashedKey(dbIndexStrs, indexStrs) {
+    return self.upsert(upserter, table, dbIndex,
+      append(append(dbFields, indexStrs...), dbIndexStrs...),
+      append(append(dbValues, keyStrs...), dbKeys...), dbFields)
+  }
+  err = self.insert(table, dbIndex,
     append(append(dbFields, indexStrs...), dbIndexStrs...),
     append(append(dbValues, keyStrs...), dbKeys...))
-  if err != nil {
-    e, _ := err.(*tdh.Error)
-    if e.ClientStatus == tdh.CLIENT_STATUS_DB_ERROR && e.ErrorCode == 121 { // update
-      _, _, err = self.conn.Update(self.handa.dbname, table, dbIndex,
-        dbFields,
-        [][]string{dbKeys}, tdh.EQ,
-        0, 0, nil, dbValues)
-    }
+  err = self.checkHashCollision(table, dbIndex, dbIndexStrs, dbKeys, indexStrs, keyStrs, err)
+  if errors.Is(err, ErrDuplicateKey) { // update
+    _, _, err = self.update(table, dbIndex, dbFields, [][]string{dbKeys}, hashFilters, dbValues)
   }
   return
 }
 
+// hasHashedKey reports whether any key column is indexed by its hash
+func hasHashedKey(dbIndexStrs []string, indexStrs []string) bool {
+  for i, column := range indexStrs {
+    if dbIndexStrs[i] != column {
+      return true
+    }
+  }
+  return false
+}
+
+// checkHashCollision turns a duplicate key error into a HashCollisionError, if the row of the same hashed key has another text
+func (self *Cursor) checkHashCollision(table string, index string, dbIndexStrs []string, dbKeys []string,
+  indexStrs []string, keyStrs []string, err error) error {
+  if !errors.Is(err, ErrDuplicateKey) {
+    return err
+  }
+  var fields, texts []string
+  for i, column := range indexStrs {
+    if dbIndexStrs[i] != column { // hashed
+      fields = append(fields, column)
+      texts = append(texts, keyStrs[i])
+    }
+  }
+  if len(fields) == 0 {
+    return err
+  }
+  rows, _, e := self.get(table, index, fields, [][]string{dbKeys}, tdh.EQ, 0, 1, nil)
+  if e != nil || len(rows) == 0 { // duplicated in other indexes
+    return err
+  }
+  for i, text := range texts {
+    if existing := string(rows[0][i]); existing != text {
+      return &HashCollisionError{table, fields[i], text, existing}
+    }
+  }
+  return err
+}
+
+// Commit sends the queued requests. Duplicate key errors of inserts are checked for hash collisions as in Insert.
+// Keys are checked against rows stored before the batch, so a collision between two inserts of the same batch is reported as ErrDuplicateKey.
 func (self *Cursor) Commit() ([]Result, error) {
-  if !self.isValid { panic("Using an invalid cursor") }
+  if self.err != nil { return nil, self.err }
+  if !self.isValid { return nil, ErrInvalidCursor }
   if !self.isBatch { return nil, nil }
-  res, err := self.conn.Commit()
-  if err != nil {
-    return nil, err
+  defer func() {
+    self.isValid = false
+    self.end <- true
+  }()
+  var ret []Result
+  var err error
+  if e := self.do(func() {
+    ret, err = self.conn.Commit()
+  }); e != nil {
+    return nil, e
   }
-  ret := make([]Result, len(res))
-  for i, r := range res {
-    switch r.T {
-    case tdh.INSERT:
-      ret[i] = Result{INSERT, r.Change, r.Count, r.Err}
-    case tdh.UPDATE:
-      ret[i] = Result{UPDATE, r.Change, r.Count, r.Err}
-    case tdh.DELETE:
-      ret[i] = Result{DELETE, r.Change, r.Count, r.Err}
+  checks := self.batchChecks
+  self.batchChecks = nil
+  if errors.Is(err, ErrDuplicateKey) { // atomic backends fail the whole batch, not telling which request
+    for _, check := range checks {
+      if check == nil {
+        continue
+      }
+      if e := check(err); errors.Is(e, ErrHashCollision) {
+        return nil, e
+      }
     }
   }
-  self.end <- true
-  return ret, nil
+  for i := range ret {
+    if i < len(checks) && checks[i] != nil {
+      ret[i].Err = checks[i](ret[i].Err)
+    }
+  }
+  return ret, err
 }
 
 type Result struct {
@@ -168,41 +344,53 @@ const (
 // get
 
 func (self *Cursor) getRows(table string, index string, fields []string, filterStrs []string, start int, limit int) (rows [][][]byte, err error) {
-  if !self.isValid { panic("Using an invalid cursor") }
-  if self.isBatch { panic("Not permit in batch mode") }
+  if self.err != nil { return nil, self.err }
+  if !self.isValid { return nil, ErrInvalidCursor }
+  if self.isBatch { return nil, ErrBatchNotPermitted }
   if !self.isBatch { defer func() {
+    self.isValid = false
     self.end <- true
   }()}
 
-  var isString []bool
-  indexCols := strings.Split(index, "$")
-  index, isString = self.handa.ensureIndexExists(table, indexCols...)
-
-  minKey := make([]string, len(isString)) // match all rows
-  for i, t := range isString {
-    if t {
-      minKey[i] = "(null)"
-    } else {
-      minKey[i] = "-9223372036854775808"
-    }
+  if err = validateIdentifiers("column", fields...); err != nil {
+    return
+  }
+  indexCols, unique := splitIndex(index)
+  index, _, err = self.handa.ensureIndexExists(self.ctx, table, unique, indexCols...)
+  if err != nil {
+    return
   }
-  key := [][]string{minKey}
-  op := tdh.GT
+  tableInfo, err := self.handa.existingTable(table)
+  if err != nil {
+    return
+  }
+
+  key := [][]string{tableInfo.minKey(index)} // match all rows
+  op := tdh.GE
   tableScan := true
 
   var filters, convertedFilters []tdh.Filter
+  var textFields, texts []string // read to verify hashes of long string filters
   if filterStrs != nil {
     convertedFilters, err = convertFilterStrings(filterStrs)
     if err != nil {
       return
     }
     filters = make([]tdh.Filter, 0, len(convertedFilters))
-    for i, filter := range convertedFilters { // convert text filed to hash field
-      if self.handa.schema[table].columnType[filter.Field] == ColTypeLongString {
-        filters[i].Field = "hash_" + filters[i].Field
-        filters[i].Value = mmh3Hex(filters[i].Value)
+    dbIndexCols, _ := splitIndex(index)
+    for _, filter := range convertedFilters { // convert text filed to hash field
+      if err = validateIdentifier("column", filter.Field); err != nil {
+        return
       }
-      if tableScan && filter.Field == indexCols[0] && isConvertableOp(filter.Op) { // use key/op to filter
+      if tableInfo.columnType[filter.Field] == ColTypeLongString {
+        if self.handa.verifyHashes && filter.Op == tdh.FILTER_EQ {
+          textFields = append(textFields, filter.Field)
+          texts = append(texts, filter.Value)
+        }
+        filter.Field = "hash_" + filter.Field
+        filter.Value = self.handa.hasher.Hash(filter.Value)
+      }
+      if tableScan && filter.Field == dbIndexCols[0] && isConvertableOp(filter.Op) { // use key/op to filter
         key = [][]string{[]string{filter.Value}}
         op = convertOp(filter.Op)
         tableScan = false
@@ -212,9 +400,22 @@ func (self *Cursor) getRows(table string, index string, fields []string, filterS
     }
   }
 
-  rows, _, err = self.conn.Get(self.handa.dbname, table, index, fields,
+  rows, _, err = self.get(table, index, append(fields[:len(fields):len(fields)], textFields...),
     key, op, uint32(start), uint32(limit), filters)
-  return
+  if err != nil || len(textFields) == 0 {
+    return
+  }
+  verified := rows[:0]
+  for _, row := range rows {
+    matched := true
+    for i, text := range texts {
+      matched = matched && string(row[len(fields) + i]) == text // or same hash of another text
+    }
+    if matched {
+      verified = append(verified, row[:len(fields)])
+    }
+  }
+  return verified, nil
 }
 
 func isConvertableOp(op uint8) (t bool) {
@@ -249,7 +450,7 @@ func (self *Cursor) getCol(table string, index string, filterStrs []string, star
     index = strings.TrimSpace(indexSplit[0])
     fields = []string{strings.TrimSpace(indexSplit[1])}
   } else {
-    fields = []string{index}
+    fields = []string{strings.TrimSuffix(index, NonUniqueSuffix)}
   }
   rows, err := self.getRows(table, index, fields, filterStrs, start, limit)
   if err != nil {
@@ -270,7 +471,7 @@ func (self *Cursor) getMultiCol(table string, fieldsStr string, filterStrs []str
       index = field
     }
     if !strings.Contains(field, "$") {
-      fields = append(fields, strings.TrimSpace(field))
+      fields = append(fields, strings.TrimSuffix(strings.TrimSpace(field), NonUniqueSuffix))
     }
   }
   rows, err := self.getRows(table, index, fields, filterStrs, start, limit)
@@ -327,7 +528,7 @@ func (self *Cursor) getMap(table string, index string, field string, filterStrs
     index = strings.TrimSpace(indexSplit[0])
     fields = []string{strings.TrimSpace(indexSplit[1]), field}
   } else {
-    fields = []string{index, field}
+    fields = []string{strings.TrimSuffix(index, NonUniqueSuffix), field}
   }
   rows, err := self.getRows(table, index, fields, filterStrs, start, limit)
   if err != nil {
@@ -346,7 +547,7 @@ func (self *Cursor) getMultiMap(table string, index string, fieldsStr string, fi
     index = strings.TrimSpace(indexSplit[0])
     fields = []string{strings.TrimSpace(indexSplit[1])}
   } else {
-    fields = []string{index}
+    fields = []string{strings.TrimSuffix(index, NonUniqueSuffix)}
   }
   for _, field := range strings.Split(fieldsStr, ",") {
     fields = append(fields, strings.TrimSpace(field))
@@ -405,8 +606,8 @@ func convertFilterStrings(strs []string) (out []tdh.Filter, err error) {
   expPat, _ := regexp.Compile("([^=><!]*)(=|>=|<=|>|<|!=)(.*)")
   for i, s := range strs {
     matches := expPat.FindAllStringSubmatch(s, len(s))
-    if len(matches) < 0 || len(matches[0]) < 4 {
-      return nil, errors.New("filter invalid: " + s)
+    if len(matches) == 0 || len(matches[0]) < 4 {
+      return nil, fmt.Errorf("%w: %q", ErrInvalidFilter, s)
     }
     var op uint8
     switch matches[0][2] {
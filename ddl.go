@@ -0,0 +1,100 @@
+package handa
+
+import (
+  "errors"
+  "sync/atomic"
+  "time"
+)
+
+// DDLStats counts DDL done by a Handa since created
+type DDLStats struct {
+  Statements int64 // DDL run
+  Skipped int64 // DDL found done by other processes
+  Locks int64 // cross-process DDL locks taken
+  LockTimeouts int64
+  LockWait time.Duration // total time waiting for locks
+}
+
+type ddlStats struct {
+  statements atomic.Int64
+  skipped atomic.Int64
+  locks atomic.Int64
+  lockTimeouts atomic.Int64
+  lockWait atomic.Int64
+}
+
+func (self *Handa) DDLStats() DDLStats {
+  return DDLStats{
+    Statements: self.ddlStats.statements.Load(),
+    Skipped: self.ddlStats.skipped.Load(),
+    Locks: self.ddlStats.locks.Load(),
+    LockTimeouts: self.ddlStats.lockTimeouts.Load(),
+    LockWait: time.Duration(self.ddlStats.lockWait.Load()),
+  }
+}
+
+// runDDL runs ddl on table and reloads the table. done reports whether the DDL is needed, given the table schema or nil if the table does not exist.
+// If the backend is a DDLLocker, ddl runs with the lock of table held, and only if still needed after reloading the table.
+func (self *Handa) runDDL(table string, done func(*TableInfo) bool, ddl func() error) (created bool, err error) {
+  if locker, ok := self.backend.(DDLLocker); ok {
+    t0 := time.Now()
+    unlock, err := locker.LockDDL(table, self.ddlLockTimeout)
+    self.ddlStats.lockWait.Add(int64(time.Since(t0)))
+    if err != nil {
+      if errors.Is(err, ErrDDLLockTimeout) {
+        self.ddlStats.lockTimeouts.Add(1)
+      }
+      return false, err
+    }
+    self.ddlStats.locks.Add(1)
+    defer unlock()
+    tableInfo, err := self.loadTableInfo(table)
+    if err != nil && !errors.Is(err, ErrNoTable) {
+      return false, err
+    }
+    if tableInfo != nil {
+      self.setTableInfo(table, tableInfo)
+    } else {
+      self.deleteTableInfo(table)
+    }
+    if done(tableInfo) {
+      self.ddlStats.skipped.Add(1)
+      return false, nil
+    }
+  }
+  self.ddlStats.statements.Add(1)
+  if err := ddl(); err != nil {
+    if err = self.recoverDDL(table, err, done); err != nil {
+      return false, err
+    }
+    self.ddlStats.skipped.Add(1)
+    return false, nil
+  }
+  tableInfo, err := self.loadTableInfo(table)
+  if errors.Is(err, ErrNoTable) { // dropped
+    self.deleteTableInfo(table)
+    return true, nil
+  }
+  if err != nil {
+    return false, err
+  }
+  self.setTableInfo(table, tableInfo)
+  return true, nil
+}
+
+// recoverDDL is called after a failed DDL, which fails if another process has done the same and the cache is stale.
+// It reloads the table, and returns nil if done reports the DDL is not needed anymore, or err otherwise.
+func (self *Handa) recoverDDL(table string, err error, done func(*TableInfo) bool) error {
+  tableInfo, loadErr := self.loadTableInfo(table)
+  if errors.Is(loadErr, ErrNoTable) {
+    self.deleteTableInfo(table)
+  } else if loadErr != nil {
+    return err
+  } else {
+    self.setTableInfo(table, tableInfo)
+  }
+  if done(tableInfo) {
+    return nil
+  }
+  return err
+}
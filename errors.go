@@ -0,0 +1,121 @@
+package handa
+
+import (
+  "errors"
+  "fmt"
+  "time"
+)
+
+var (
+  ErrClosed = errors.New("handa closed")
+  ErrKeyCountMismatch = errors.New("index and key not match in number")
+  ErrFieldCountMismatch = errors.New("fields and values not match in number")
+  ErrInvalidFilter = errors.New("invalid filter")
+  ErrUnsupportedType = errors.New("unsupported type")
+  ErrInvalidCursor = errors.New("using an invalid cursor")
+  ErrBatchNotPermitted = errors.New("not permit in batch mode")
+  ErrDuplicateKey = errors.New("duplicate key")
+  ErrUndeclared = errors.New("undeclared schema")
+  ErrNoTable = errors.New("no such table")
+  ErrDDLLockTimeout = errors.New("ddl lock timeout")
+  ErrDDLForbidden = errors.New("ddl forbidden")
+  ErrInvalidIdentifier = errors.New("invalid identifier")
+  ErrHashCollision = errors.New("hash collision")
+)
+
+// DDLError is returned when handa fails to create a table, column or index.
+type DDLError struct {
+  Table string
+  Statement string
+  Err error
+}
+
+func (self *DDLError) Error() string {
+  return fmt.Sprintf("table %s ddl error: %v, statement: %s", self.Table, self.Err, self.Statement)
+}
+
+func (self *DDLError) Unwrap() error {
+  return self.Err
+}
+
+// UndeclaredError is returned in strict mode when a write needs a table, column or index not declared.
+// errors.Is(err, ErrUndeclared) is true.
+type UndeclaredError struct {
+  Table string
+  Kind string // table, column or index
+  Name string
+}
+
+func (self *UndeclaredError) Error() string {
+  return fmt.Sprintf("strict mode: table %s has no %s %s and it is not declared", self.Table, self.Kind, self.Name)
+}
+
+func (self *UndeclaredError) Is(target error) bool {
+  return target == ErrUndeclared
+}
+
+// DDLLockTimeoutError is returned when the cross-process DDL lock of a table is not taken in time.
+// errors.Is(err, ErrDDLLockTimeout) is true.
+type DDLLockTimeoutError struct {
+  Table string
+  Timeout time.Duration
+}
+
+func (self *DDLLockTimeoutError) Error() string {
+  return fmt.Sprintf("table %s ddl lock not taken in %v", self.Table, self.Timeout)
+}
+
+func (self *DDLLockTimeoutError) Is(target error) bool {
+  return target == ErrDDLLockTimeout
+}
+
+// InvalidIdentifierError is returned before any statement is sent when a table, column or index name is not accepted.
+// errors.Is(err, ErrInvalidIdentifier) is true.
+type InvalidIdentifierError struct {
+  Kind string // table, column or index
+  Name string
+  Reason string
+}
+
+func (self *InvalidIdentifierError) Error() string {
+  return fmt.Sprintf("invalid %s name %q: %s", self.Kind, self.Name, self.Reason)
+}
+
+func (self *InvalidIdentifierError) Is(target error) bool {
+  return target == ErrInvalidIdentifier
+}
+
+// HashCollisionError is returned when a write finds another string of the same hash in a hashed key.
+// errors.Is(err, ErrHashCollision) is true.
+type HashCollisionError struct {
+  Table string
+  Column string
+  Value string
+  Existing string
+}
+
+func (self *HashCollisionError) Error() string {
+  return fmt.Sprintf("table %s column %s: %q has the same hash as existing %q", self.Table, self.Column, self.Value, self.Existing)
+}
+
+func (self *HashCollisionError) Is(target error) bool {
+  return target == ErrHashCollision
+}
+
+// duplicateKeyError wraps a backend error meaning duplicated unique key.
+// errors.Is(err, ErrDuplicateKey) is true, and the backend error is still reachable by errors.As.
+type duplicateKeyError struct {
+  err error
+}
+
+func (self *duplicateKeyError) Error() string {
+  return "duplicate key: " + self.err.Error()
+}
+
+func (self *duplicateKeyError) Is(target error) bool {
+  return target == ErrDuplicateKey
+}
+
+func (self *duplicateKeyError) Unwrap() error {
+  return self.err
+}
@@ -1,118 +1,334 @@
 package handa
 
 import (
+  "context"
+  "errors"
   "log"
   "fmt"
   "strings"
   "sync"
+  "time"
 
-  tdh "github.com/reusee/go-tdhsocket"
   "github.com/reusee/mmh3"
 
-  "github.com/ziutek/mymysql/autorc"
   "github.com/ziutek/mymysql/mysql"
-  _ "github.com/ziutek/mymysql/native"
 )
 
 var (
   MysqlConnPoolSize = 16
   SocketConnPoolSize = 256
+  DDLLockTimeout = time.Second * 10
+  MigrationLockTimeout = time.Hour
+)
+
+// drivers selectable by Config.Driver
+const (
+  DriverTdh = "tdh"
+  DriverSQL = "sql"
+  DriverMemory = "memory"
 )
 
 type Handa struct {
-  mysqlConnPool chan *autorc.Conn
-  socketConnPool chan *tdh.Conn
+  backend Backend
 
-  dbname string
+  // schema holds immutable snapshots, replaced as a whole after DDL.
+  // schemaMutex guards schema, columnDDL and indexDDL.
+  schemaMutex sync.RWMutex
   schema map[string]*TableInfo
-
-  tableCacheVarMutex *sync.Mutex
-  tableCacheVarCount int
-
-  tableDDL chan tableDDLReq
   columnDDL map[string]chan columnDDLReq
   indexDDL map[string]chan indexDDLReq
+  tableDDL chan tableDDLReq
+
+  strict bool // no DDL for all tables
+  strictTables map[string]bool // no DDL for these tables
+  ddlLockTimeout time.Duration
+  migrationLockTimeout time.Duration
+  ddlStats ddlStats
+  hasher Hasher
+  verifyHashes bool
+
+  closeMutex sync.RWMutex
+  closed bool
+  quit chan struct{} // closed when shutting down, stops DDL listeners
+  cursors sync.WaitGroup
+}
+
+type Config struct {
+  Host string
+  Port string
+  User string
+  Password string
+  Database string
+  Charset string // default utf8
+
+  TdhPort string
+  TdhReadPassword string
+  TdhWritePassword string
+  TdhDDL string // TdhDDLToggle, TdhDDLFlush or TdhDDLForbidden, default TdhDDLToggle
+
+  MysqlConnPoolSize int // default MysqlConnPoolSize
+  SocketConnPoolSize int // default SocketConnPoolSize
+  DialTimeout time.Duration // zero means no timeout
+
+  Driver string // DriverTdh, DriverSQL or DriverMemory, default DriverTdh
+  Backend Backend // if set, used instead of the one chosen by Driver
+
+  Schema []TableDef // created at startup
+  Preload []string // tables loaded at startup, others are loaded when first used
+  SchemaPollInterval time.Duration // reload tables changed by other processes at this interval, zero means no polling
+  DDLLockTimeout time.Duration // max time waiting for other processes doing DDL on the same table, default DDLLockTimeout
+  Strict bool // reject writes that need DDL not in Schema, for all tables
+  Migrations []Migration // applied at startup, after Schema
+  MigrationLockTimeout time.Duration // max time waiting for other processes migrating the same database, default MigrationLockTimeout
+  Hasher Hasher // hashes long strings in hash columns, default MMH3Hasher
+  VerifyHashes bool // check texts behind hashes, dropping mismatched rows in reads and not updating them in writes
+}
+
+func (config Config) withDefaults() Config {
+  if config.Charset == "" {
+    config.Charset = "utf8"
+  }
+  if config.MysqlConnPoolSize <= 0 {
+    config.MysqlConnPoolSize = MysqlConnPoolSize
+  }
+  if config.SocketConnPoolSize <= 0 {
+    config.SocketConnPoolSize = SocketConnPoolSize
+  }
+  if config.DDLLockTimeout <= 0 {
+    config.DDLLockTimeout = DDLLockTimeout
+  }
+  if config.MigrationLockTimeout <= 0 {
+    config.MigrationLockTimeout = MigrationLockTimeout
+  }
+  if config.Hasher == nil {
+    config.Hasher = MMH3Hasher
+  }
+  return config
 }
 
 func New(host string, port string, user string, password string, database string, tdhPort string) *Handa {
+  self, err := NewWithConfig(Config{
+    Host: host,
+    Port: port,
+    User: user,
+    Password: password,
+    Database: database,
+    TdhPort: tdhPort,
+  })
+  if err != nil {
+    fatal("%v", err)
+  }
+  return self
+}
+
+func NewWithConfig(config Config) (*Handa, error) {
+  config = config.withDefaults()
+  if err := checkHasher(config.Hasher); err != nil {
+    return nil, err
+  }
+  backend := config.Backend
+  if backend == nil {
+    var err error
+    switch config.Driver {
+    case DriverTdh, "":
+      backend, err = NewTdhBackend(config)
+    case DriverSQL:
+      backend, err = NewSQLBackend(config)
+    case DriverMemory:
+      backend = NewMemoryBackend()
+    default:
+      err = fmt.Errorf("unknown driver %s", config.Driver)
+    }
+    if err != nil {
+      return nil, err
+    }
+  }
+
   self := &Handa{
-    tableCacheVarMutex: new(sync.Mutex),
+    backend: backend,
+    schema: make(map[string]*TableInfo),
+    columnDDL: make(map[string]chan columnDDLReq),
+    indexDDL: make(map[string]chan indexDDLReq),
+    strictTables: make(map[string]bool),
+    ddlLockTimeout: config.DDLLockTimeout,
+    migrationLockTimeout: config.MigrationLockTimeout,
+    hasher: config.Hasher,
+    verifyHashes: config.VerifyHashes,
+    quit: make(chan struct{}),
+  }
+  fail := func(err error) (*Handa, error) {
+    close(self.quit)
+    backend.Close()
+    return nil, err
   }
 
   // DDL listeners
   self.startTableDDLListener()
-  self.columnDDL = make(map[string]chan columnDDLReq)
-  self.indexDDL = make(map[string]chan indexDDLReq)
-
-  // init database connection pool
-  self.dbname = database
-  self.mysqlConnPool = make(chan *autorc.Conn, MysqlConnPoolSize)
-  for i := 0; i < MysqlConnPoolSize; i++ {
-    conn := autorc.New("tcp", "", host + ":" + port, user, password, database)
-    conn.Register("set names utf8")
-    self.mysqlConnPool <- conn
-  }
-  self.socketConnPool = make(chan *tdh.Conn, SocketConnPoolSize)
-  for i := 0; i < SocketConnPoolSize; i++ {
-    socket, err := tdh.New(host + ":" + tdhPort, "", "")
+
+  // load table schemas
+  for _, tableName := range config.Preload {
+    if _, err := self.loadTable(tableName); err != nil {
+      return fail(err)
+    }
+  }
+
+  // declared schema, before strict mode takes effect
+  if err := self.applySchema(context.Background(), config.Schema); err != nil {
+    return fail(err)
+  }
+  self.strict = config.Strict
+
+  if len(config.Migrations) > 0 {
+    if err := self.Migrate(config.Migrations...); err != nil {
+      return fail(err)
+    }
+  }
+
+  if versioner, ok := backend.(SchemaVersioner); ok && config.SchemaPollInterval > 0 {
+    go self.pollSchema(versioner, config.SchemaPollInterval)
+  }
+
+  return self, nil
+}
+
+// pollSchema reloads loaded tables whose versions changed, and forgets those dropped
+func (self *Handa) pollSchema(versioner SchemaVersioner, interval time.Duration) {
+  versions, _ := versioner.SchemaVersions()
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-ticker.C:
+    case <-self.quit:
+      return
+    }
+    current, err := versioner.SchemaVersions()
     if err != nil {
-      fatal("Tdhsocket connect error")
+      continue
     }
-    self.socketConnPool <- socket
+    for _, table := range self.Tables() {
+      version, exists := current[table]
+      if !exists {
+        self.deleteTableInfo(table)
+      } else if last, ok := versions[table]; !ok || last != version {
+        if tableInfo, err := self.loadTableInfo(table); err == nil {
+          self.setTableInfo(table, tableInfo)
+        } else if errors.Is(err, ErrNoTable) {
+          self.deleteTableInfo(table)
+        }
+      }
+    }
+    versions = current
   }
+}
 
-  // load table schemas
-  schema := make(map[string]*TableInfo)
-  row, _, _ := self.mysqlQuery("SHOW TABLES")
-  for _, row := range row {
-    tableName := row.Str(0)
-    schema[tableName] = self.loadTableInfo(tableName)
+// Close waits for in-flight cursors, stops the DDL listeners and closes all
+// connections. If ctx is done before the cursors finish, Close returns ctx.Err()
+// and the connections held by those cursors are closed when they are released.
+func (self *Handa) Close(ctx context.Context) error {
+  self.closeMutex.Lock()
+  if self.closed {
+    self.closeMutex.Unlock()
+    return ErrClosed
   }
-  self.schema = schema
+  self.closed = true
+  self.closeMutex.Unlock()
 
-  return self
+  var err error
+  drained := make(chan struct{})
+  go func() {
+    self.cursors.Wait()
+    close(drained)
+  }()
+  select {
+  case <-drained:
+  case <-ctx.Done():
+    err = ctx.Err()
+  }
+  close(self.quit)
+  self.backend.Close()
+  return err
+}
+
+func (self *Handa) loadTableInfo(tableName string) (*TableInfo, error) {
+  tableInfo, err := self.backend.LoadTable(tableName)
+  if err != nil {
+    return nil, err
+  }
+  self.ddlListeners(tableName)
+  return tableInfo, nil
 }
 
-func (self *Handa) loadTableInfo(tableName string) *TableInfo {
-  if self.columnDDL[tableName] == nil {
-    self.startColumnDDLListener(tableName)
+// loadTable returns the schema of table, loading it at first use. It returns nil if the table does not exist.
+func (self *Handa) loadTable(table string) (*TableInfo, error) {
+  if tableInfo := self.tableInfo(table); tableInfo != nil {
+    return tableInfo, nil
   }
-  if self.indexDDL[tableName] == nil {
-    self.startIndexDDLListener(tableName)
+  tableInfo, err := self.loadTableInfo(table)
+  if errors.Is(err, ErrNoTable) {
+    return nil, nil
   }
-  tableInfo := &TableInfo{
-    name: tableName,
-    columnType: make(map[string]int),
-    index: make(map[string]bool),
+  if err != nil {
+    return nil, err
   }
-  r, _, _ := self.mysqlQuery("DESCRIBE %s", tableName)
-  for _, c := range r {
-    columnName := c.Str(0)
-    columnType := c.Str(1)
-    switch columnType {
-    case "tinyint(1)":
-      tableInfo.columnType[columnName] = ColTypeBool
-    case "bigint(255)":
-      tableInfo.columnType[columnName] = ColTypeInt
-    case "double":
-      tableInfo.columnType[columnName] = ColTypeFloat
-    case "longtext", "longblob":
-      tableInfo.columnType[columnName] = ColTypeLongString
-    case "varchar(255)":
-      tableInfo.columnType[columnName] = ColTypeString
-    case "char(32)":
-      tableInfo.columnType[columnName] = ColTypeHash
-    }
+  self.schemaMutex.Lock()
+  defer self.schemaMutex.Unlock()
+  if cached := self.schema[table]; cached != nil { // loaded or changed by DDL meanwhile
+    return cached, nil
   }
-  r, _, _ = self.mysqlQuery("SHOW INDEXES IN %s", tableName)
-  for _, c := range r { // load unique keys
-    isUnique := c.Int(1) == 0
-    keyName := c.Str(2)
-    if isUnique {
-      tableInfo.index[keyName] = true
-    }
+  self.schema[table] = tableInfo
+  return tableInfo, nil
+}
+
+// existingTable returns the schema snapshot of table, reloading it if dropped from the cache, or ErrNoTable.
+// Tables may be dropped at any time, so the snapshot is taken once and used in place of tableInfo(table).
+func (self *Handa) existingTable(table string) (*TableInfo, error) {
+  tableInfo, err := self.loadTable(table)
+  if err != nil {
+    return nil, err
+  }
+  if tableInfo == nil {
+    return nil, fmt.Errorf("%w: %s", ErrNoTable, table)
+  }
+  return tableInfo, nil
+}
+
+// tableInfo returns the schema snapshot of table, nil if the table is not loaded
+func (self *Handa) tableInfo(table string) *TableInfo {
+  self.schemaMutex.RLock()
+  defer self.schemaMutex.RUnlock()
+  return self.schema[table]
+}
+
+func (self *Handa) setTableInfo(table string, tableInfo *TableInfo) {
+  self.schemaMutex.Lock()
+  defer self.schemaMutex.Unlock()
+  self.schema[table] = tableInfo
+}
+
+func (self *Handa) deleteTableInfo(table string) {
+  self.schemaMutex.Lock()
+  defer self.schemaMutex.Unlock()
+  delete(self.schema, table)
+}
+
+// ddlListeners returns the column and index DDL channels of table, starting the listeners at first use
+func (self *Handa) ddlListeners(table string) (chan columnDDLReq, chan indexDDLReq) {
+  self.schemaMutex.RLock()
+  columnDDL, indexDDL := self.columnDDL[table], self.indexDDL[table]
+  self.schemaMutex.RUnlock()
+  if columnDDL != nil && indexDDL != nil {
+    return columnDDL, indexDDL
+  }
+  self.schemaMutex.Lock()
+  defer self.schemaMutex.Unlock()
+  if self.columnDDL[table] == nil {
+    self.columnDDL[table] = self.startColumnDDLListener(table)
+  }
+  if self.indexDDL[table] == nil {
+    self.indexDDL[table] = self.startIndexDDLListener(table)
   }
-  return tableInfo
+  return self.columnDDL[table], self.indexDDL[table]
 }
 
 const (
@@ -122,30 +338,101 @@ const (
   ColTypeString
   ColTypeLongString
   ColTypeHash
+  ColTypeTime
+  ColTypeDecimal
+  ColTypeUint
+  ColTypeUnknown // existing columns of types handa does not write, like enum or date
 )
 
+var colTypeNames = []string{
+  "ColTypeBool", "ColTypeInt", "ColTypeFloat", "ColTypeString", "ColTypeLongString",
+  "ColTypeHash", "ColTypeTime", "ColTypeDecimal", "ColTypeUint", "ColTypeUnknown",
+}
+
+// ColTypeName returns the name of a ColType* constant, like "ColTypeInt"
+func ColTypeName(t int) string {
+  if t < 0 || t >= len(colTypeNames) {
+    return fmt.Sprintf("ColType(%d)", t)
+  }
+  return colTypeNames[t]
+}
+
+// TableInfo is a snapshot of a table schema, not modified after loaded
 type TableInfo struct {
   name string
   columnType map[string]int
-  index map[string]bool
+  columns map[string]*ColumnInfo
+  columnNames []string // in DESCRIBE order
+  index map[string]bool // index name to whether it is unique
+}
+
+func newTableInfo(name string) *TableInfo {
+  return &TableInfo{
+    name: name,
+    columnType: make(map[string]int),
+    columns: make(map[string]*ColumnInfo),
+    index: make(map[string]bool),
+  }
+}
+
+// indexColumns returns the columns of index, with hash columns mapped back to the long string columns they hash
+func (self *TableInfo) indexColumns(index string) []string {
+  if index == "PRIMARY" {
+    return []string{"serial"}
+  }
+  columns, _ := splitIndex(index)
+  for i, c := range columns {
+    if self.isHashColumn(c) {
+      columns[i] = c[5:]
+    }
+  }
+  return columns
 }
 
+// NonUniqueSuffix marks an index argument of reads as a non-unique index, like GetFilteredMap(table, "city" + NonUniqueSuffix, ...),
+// to read many rows of the same key. Unique and non-unique indexes on the same columns are different indexes.
+const NonUniqueSuffix = "~"
+
+// splitIndex returns the columns of an index name or argument, and whether the index is unique
+func splitIndex(index string) (columns []string, unique bool) {
+  unique = !strings.HasSuffix(index, NonUniqueSuffix)
+  return strings.Split(strings.TrimSuffix(index, NonUniqueSuffix), "$"), unique
+}
+
+// isHashColumn reports whether column holds the hashes of a long string column
+func (self *TableInfo) isHashColumn(column string) bool {
+  return strings.HasPrefix(column, "hash_") && self.columnType[column[5:]] == ColTypeLongString
+}
+
+func (self *TableInfo) addColumn(column *ColumnInfo) {
+  if _, ok := self.columns[column.Name]; !ok {
+    self.columnNames = append(self.columnNames, column.Name)
+  }
+  self.columnType[column.Name] = column.Type
+  self.columns[column.Name] = column
+}
+
+// mysqlQuery runs sql on backends talking to MySQL
 func (self *Handa) mysqlQuery(sql string, args ...interface{}) ([]mysql.Row, mysql.Result, error) {
-  conn := <-self.mysqlConnPool
-  defer func() {
-    self.mysqlConnPool <- conn
-  }()
-  return conn.Query(sql, args...)
+  q, ok := self.backend.(interface {
+    Query(sql string, args ...interface{}) ([]mysql.Row, mysql.Result, error)
+  })
+  if !ok {
+    return nil, nil, errors.New("backend does not support sql")
+  }
+  return q.Query(sql, args...)
 }
 
-func (self *Handa) checkSchemaAndConvertData(table string, indexesStr string, keys interface{},
+func (self *Handa) checkSchemaAndConvertData(ctx context.Context, table string, indexesStr string, keys interface{},
   fieldList string, values ...interface{}) (dbIndex string,
   dbIndexStrs []string, dbKeys []string,
   indexStrs []string, keyStrs []string,
-  dbFields []string, dbValues []string) {
+  dbFields []string, dbValues []string, err error) {
 
   // table
-  self.ensureTableExists(table)
+  if err = self.ensureTableExists(ctx, table); err != nil {
+    return
+  }
 
   // index and key
   // split indexes
@@ -153,6 +440,9 @@ func (self *Handa) checkSchemaAndConvertData(table string, indexesStr string, ke
   for i, indexStr := range indexStrs {
     indexStrs[i] = strings.TrimSpace(indexStr)
   }
+  if err = validateIdentifiers("column", indexStrs...); err != nil {
+    return
+  }
   var keyList []interface{}
   if len(indexStrs) > 1 {
     keyList, _ = keys.([]interface{})
@@ -160,25 +450,36 @@ func (self *Handa) checkSchemaAndConvertData(table string, indexesStr string, ke
     keyList = []interface{}{keys}
   }
   if len(keyList) != len(indexStrs) {
-    log.Fatal("index and key not match in number")
+    err = ErrKeyCountMismatch
+    return
   }
   // convert keys to string
   // ensure key columns exists
   keyStrs = make([]string, len(keyList))
   for i, key := range keyList {
-    keyStr, t := convertToString(key)
+    var keyStr string
+    var t int
+    keyStr, t, err = convertToString(key)
+    if err != nil {
+      return
+    }
     keyStrs[i] = keyStr
-    self.ensureColumnExists(table, indexStrs[i], t)
+    if _, err = self.ensureColumnExists(ctx, table, indexStrs[i], t, keyStr); err != nil {
+      return
+    }
   }
   // ensure index exists
   var isString []bool
-  dbIndex, isString = self.ensureIndexExists(table, indexStrs...)
+  dbIndex, isString, err = self.ensureIndexExists(ctx, table, true, indexStrs...)
+  if err != nil {
+    return
+  }
   dbKeys = make([]string, len(keyList))
   dbIndexStrs = make([]string, len(keyList))
   for i, index := range indexStrs {
     if isString[i] {
       dbIndexStrs[i] = "hash_" + index
-      dbKeys[i] = mmh3Hex(keyStrs[i])
+      dbKeys[i] = self.hasher.Hash(keyStrs[i])
     } else {
       dbIndexStrs[i] = index
       dbKeys[i] = keyStrs[i]
@@ -190,239 +491,542 @@ func (self *Handa) checkSchemaAndConvertData(table string, indexesStr string, ke
   if len(fields) == 1 && fields[0] == "" {
     fields = nil
   }
+  if len(fields) != len(values) {
+    err = ErrFieldCountMismatch
+    return
+  }
   dbFields = make([]string, 0, len(fields))
   dbValues = make([]string, 0, len(fields))
   for i, field := range fields {
     dbField := strings.TrimSpace(field)
+    if err = validateIdentifier("column", dbField); err != nil {
+      return
+    }
     dbFields = append(dbFields, dbField)
-    dbValue, t := convertToString(values[i])
+    var dbValue string
+    var t int
+    dbValue, t, err = convertToString(values[i])
+    if err != nil {
+      return
+    }
     dbValues = append(dbValues, dbValue)
-    self.ensureColumnExists(table, dbField, t)
+    if _, err = self.ensureColumnExists(ctx, table, dbField, t, dbValue); err != nil {
+      return
+    }
     if t == ColTypeLongString {
-      fieldHashField := "hash_" + field
-      if _, hasHashColumn := self.schema[table].columnType[fieldHashField]; hasHashColumn {
+      var tableInfo *TableInfo
+      if tableInfo, err = self.existingTable(table); err != nil {
+        return
+      }
+      fieldHashField := "hash_" + dbField
+      if _, hasHashColumn := tableInfo.columnType[fieldHashField]; hasHashColumn {
         dbFields = append(dbFields, fieldHashField)
-        dbValues = append(dbValues, mmh3Hex(dbValue))
+        dbValues = append(dbValues, self.hasher.Hash(dbValue))
       }
     }
   }
   return
 }
 
-func (self *Handa) withTableCacheOff(fun func()) {
-  self.tableCacheVarMutex.Lock()
-  self.tableCacheVarCount++
-  if self.tableCacheVarCount == 1 {
-    _, _, err := self.mysqlQuery("SET GLOBAL tdh_socket_cache_table_on=0")
-    if err != nil {
-      panic("need SUPER privileges to set global variable")
-    }
-  }
-  self.tableCacheVarMutex.Unlock()
-  defer func() {
-    self.tableCacheVarMutex.Lock()
-    self.tableCacheVarCount--
-    if self.tableCacheVarCount == 0 {
-      self.mysqlQuery("SET GLOBAL tdh_socket_cache_table_on=1")
-    }
-    self.tableCacheVarMutex.Unlock()
-  }()
-  fun()
+type ddlResult struct {
+  created bool
+  err error
 }
 
+
 type tableDDLReq struct {
   table string
-  resp chan bool
+  resp chan ddlResult
+  drop bool
 }
 
 func (self *Handa) startTableDDLListener() {
   self.tableDDL = make(chan tableDDLReq)
   go func() {
     for {
-      req := <-self.tableDDL
-      _, exists := self.schema[req.table]
-      if exists {
-        req.resp <- true
+      var req tableDDLReq
+      select {
+      case req = <-self.tableDDL:
+      case <-self.quit:
+        return
+      }
+      if req.drop {
+        created, err := self.runDDL(req.table, func(tableInfo *TableInfo) bool {
+          return tableInfo == nil
+        }, func() error {
+          return self.backend.DropTable(req.table)
+        })
+        req.resp <- ddlResult{created, err}
+        continue
+      }
+      tableInfo, err := self.loadTable(req.table)
+      if err != nil {
+        req.resp <- ddlResult{false, err}
+        continue
+      }
+      if tableInfo != nil {
+        req.resp <- ddlResult{false, nil}
+        continue
+      }
+      if self.isStrict(req.table) {
+        req.resp <- ddlResult{false, &UndeclaredError{req.table, "table", req.table}}
+        continue
+      }
+      if err := validateNewIdentifier("table", req.table); err != nil {
+        req.resp <- ddlResult{false, err}
         continue
       }
       //fmt.Printf("creating table %s\n", req.table)
-      self.withTableCacheOff(func() {
-        self.mysqlQuery(`CREATE TABLE IF NOT EXISTS %s (
-          serial SERIAL
-        ) engine=InnoDB`, req.table)
+      created, err := self.runDDL(req.table, func(tableInfo *TableInfo) bool {
+        return tableInfo != nil
+      }, func() error {
+        return self.backend.CreateTable(req.table)
       })
-      self.schema[req.table] = self.loadTableInfo(req.table)
-      req.resp <- true
+      req.resp <- ddlResult{created, err}
     }
   }()
 }
 
-func (self *Handa) ensureTableExists(table string) {
-  _, exists := self.schema[table]
-  if !exists {
-    resp := make(chan bool)
-    self.tableDDL <- tableDDLReq{table, resp}
-    <-resp
+func (self *Handa) ensureTableExists(ctx context.Context, table string) error {
+  if err := validateIdentifier("table", table); err != nil {
+    return err
+  }
+  tableInfo, err := self.loadTable(table)
+  if err != nil {
+    return err
+  }
+  if tableInfo == nil { // only creation goes through the table DDL listener
+    _, err = self.requestTableDDL(ctx, tableDDLReq{table: table})
+  }
+  return err
+}
+
+func (self *Handa) requestTableDDL(ctx context.Context, req tableDDLReq) (created bool, err error) {
+  req.resp = make(chan ddlResult, 1)
+  select {
+  case self.tableDDL <- req:
+  case <-ctx.Done():
+    return false, ctx.Err()
+  case <-self.quit:
+    return false, ErrClosed
+  }
+  select {
+  case res := <-req.resp:
+    return res.created, res.err
+  case <-ctx.Done():
+    return false, ctx.Err()
   }
 }
 
-func (self *Handa) ensureColumnExists(table string, column string, t int) (created bool) {
+func (self *Handa) ensureColumnExists(ctx context.Context, table string, column string, t int, value string) (created bool, err error) {
   if column == "serial" {
     return
   }
-  _, exists := self.schema[table].columnType[column]
+  tableInfo, err := self.existingTable(table)
+  if err != nil {
+    return false, err
+  }
+  info, exists := tableInfo.columns[column]
   if !exists {
-    var columnType, defaultValue string
-    switch t {
-    case ColTypeBool:
-      columnType = "BOOLEAN"
-      defaultValue = "0"
-    case ColTypeInt:
-      columnType = "BIGINT(255)"
-      defaultValue = "0"
-    case ColTypeFloat:
-      columnType = "DOUBLE"
-      defaultValue = "0"
-    case ColTypeLongString:
-      columnType = "LONGTEXT"
-      defaultValue = "''"
-    case ColTypeString:
-      columnType = "VARCHAR(255)"
-      defaultValue = "''"
-    case ColTypeHash:
-      columnType = "CHAR(32)"
-      defaultValue = "''"
+    if self.isStrict(table) {
+      return false, &UndeclaredError{table, "column", column}
+    }
+    if t == ColTypeHash { // named after existing columns, only the length may be invalid
+      if len(column) > MaxIdentifierLength {
+        return false, &InvalidIdentifierError{"column", column, fmt.Sprintf("longer than %d bytes", MaxIdentifierLength)}
+      }
+    } else if err := validateNewIdentifier("column", column); err != nil {
+      return false, err
+    }
+    return self.requestColumnDDL(ctx, table, columnDDLReq{column: column, t: t})
+  }
+  widened, ok := widenType(info, t, value)
+  if !ok {
+    return
+  }
+  if self.isStrict(table) {
+    return false, &UndeclaredError{table, "wider column", column}
+  }
+  // indexes are dropped when a string column becomes long string, and rebuilt on its hash
+  var indexes map[string][]string
+  if widened == ColTypeLongString {
+    indexes = tableInfo.indexesOf(column)
+  }
+  if _, err = self.requestColumnDDL(ctx, table, columnDDLReq{column: column, t: t, value: value}); err != nil {
+    return
+  }
+  for index, columns := range indexes {
+    _, unique := splitIndex(index)
+    if _, _, err = self.ensureIndexExists(ctx, table, unique, columns...); err != nil {
+      return
     }
-    resp := make(chan bool)
-    self.columnDDL[table] <- columnDDLReq{resp, column, columnType, defaultValue}
-    created = <-resp
   }
   return
 }
 
+// requestColumnDDL asks the column DDL listener to create the column, or widen it for values of type t
+func (self *Handa) requestColumnDDL(ctx context.Context, table string, req columnDDLReq) (created bool, err error) {
+  columnDDL, _ := self.ddlListeners(table)
+  req.resp = make(chan ddlResult, 1)
+  select {
+  case columnDDL <- req:
+  case <-ctx.Done():
+    return false, ctx.Err()
+  case <-self.quit:
+    return false, ErrClosed
+  }
+  select {
+  case res := <-req.resp:
+    return res.created, res.err
+  case <-ctx.Done():
+    return false, ctx.Err()
+  }
+}
+
+func (self *Handa) requestIndexDDL(ctx context.Context, table string, req indexDDLReq) (created bool, err error) {
+  _, indexDDL := self.ddlListeners(table)
+  req.resp = make(chan ddlResult, 1)
+  select {
+  case indexDDL <- req:
+  case <-ctx.Done():
+    return false, ctx.Err()
+  case <-self.quit:
+    return false, ErrClosed
+  }
+  select {
+  case res := <-req.resp:
+    return res.created, res.err
+  case <-ctx.Done():
+    return false, ctx.Err()
+  }
+}
+
+// widenType returns the type column should become to store value of type t.
+// Only decimal columns hold both negative and unsigned 64 bit integers.
+// A column too narrow for value, like varchar(64), is widened to the definition of its own type.
+func widenType(column *ColumnInfo, t int, value string) (int, bool) {
+  current := column.Type
+  switch current {
+  case ColTypeBool:
+    if t == ColTypeInt || t == ColTypeUint || t == ColTypeFloat || t == ColTypeDecimal {
+      return t, true
+    }
+  case ColTypeInt, ColTypeUint:
+    if t == ColTypeFloat || t == ColTypeDecimal {
+      return t, true
+    }
+    if current == ColTypeInt && t == ColTypeUint || current == ColTypeUint && t == ColTypeInt {
+      // values of the other signedness in range of the column's own type keep it integer
+      wide := &ColumnInfo{Type: current, BaseType: "bigint", Unsigned: current == ColTypeUint}
+      if value == "" || !wide.fits(t, value) {
+        return ColTypeDecimal, true
+      }
+    }
+  case ColTypeString:
+    if t == ColTypeLongString {
+      return t, true
+    }
+  }
+  if !column.fits(t, value) {
+    return current, true
+  }
+  return current, false
+}
+
+// indexesOf returns the indexes containing column, mapped to the columns to pass to ensureIndexExists
+func (self *TableInfo) indexesOf(column string) map[string][]string {
+  ret := make(map[string][]string)
+  for index := range self.index {
+    columns, _ := splitIndex(index)
+    for _, c := range columns {
+      if c == column {
+        ret[index] = self.indexColumns(index)
+        break
+      }
+    }
+  }
+  return ret
+}
+
 type columnDDLReq struct {
-  resp chan bool
+  resp chan ddlResult
   column string
-  columnType string
-  defaultValue string
+  t int
+  value string // the value to store, the column is widened if it does not fit
+  drop bool
+  rename string // new name
+}
+
+// done reports whether the column exists and holds values of type t, or is dropped or renamed
+func (self columnDDLReq) done(tableInfo *TableInfo) bool {
+  if tableInfo == nil {
+    return self.drop
+  }
+  column, exists := tableInfo.columns[self.column]
+  if self.drop {
+    return !exists
+  }
+  if self.rename != "" {
+    _, renamed := tableInfo.columnType[self.rename]
+    return !exists && renamed
+  }
+  if !exists {
+    return false
+  }
+  _, wider := widenType(column, self.t, self.value)
+  return !wider
 }
 
-func (self *Handa) startColumnDDLListener(table string) {
+func (self *Handa) startColumnDDLListener(table string) chan columnDDLReq {
   //fmt.Printf("start columnDDL listener of %s\n", table)
-  self.columnDDL[table] = make(chan columnDDLReq)
+  reqs := make(chan columnDDLReq)
   go func() {
     for {
-      req := <-self.columnDDL[table]
+      var req columnDDLReq
+      select {
+      case req = <-reqs:
+      case <-self.quit:
+        return
+      }
       //fmt.Printf("req table %s column %s\n", table, req.column)
-      _, exists := self.schema[table].columnType[req.column]
-      if exists {
+      if req.done(self.tableInfo(table)) {
         //println("exists")
-        req.resp <- false
+        req.resp <- ddlResult{false, nil}
         continue
       }
-      //fmt.Printf("creating column %s in table %s\n", req.column, table)
-      self.withTableCacheOff(func() {
-        self.mysqlQuery("ALTER TABLE `%s` ADD (`%s` %s NULL DEFAULT %s)",
-        table, req.column, req.columnType, req.defaultValue)
+      created, err := self.runDDL(table, req.done, func() error {
+        // runDDL reloads the table, which may be dropped meanwhile
+        tableInfo := self.tableInfo(table)
+        if tableInfo == nil {
+          return fmt.Errorf("%w: %s", ErrNoTable, table)
+        }
+        if req.drop {
+          return self.dropColumn(table, tableInfo, req.column)
+        } else if req.rename != "" {
+          return self.renameColumn(table, tableInfo, req.column, req.rename)
+        }
+        column, exists := tableInfo.columns[req.column]
+        if exists {
+          widened, _ := widenType(column, req.t, req.value)
+          return self.widenColumn(table, tableInfo, req.column, widened)
+        }
+        //fmt.Printf("creating column %s in table %s\n", req.column, table)
+        return self.backend.AddColumn(table, req.column, req.t)
       })
-      self.schema[table] = self.loadTableInfo(table)
-      req.resp <- true
+      req.resp <- ddlResult{created, err}
     }
   }()
+  return reqs
+}
+
+// minKey returns a key not greater than any key of the index, to match all rows with op GE
+func (self *TableInfo) minKey(index string) []string {
+  columns, _ := splitIndex(index)
+  key := make([]string, len(columns))
+  for i, column := range columns {
+    t := ColTypeUint // serial
+    if column != "serial" {
+      t = self.columnType[column]
+    }
+    switch t {
+    case ColTypeHash:
+      key[i] = "(null)"
+    case ColTypeString:
+      key[i] = ""
+    case ColTypeUint:
+      key[i] = "0"
+    case ColTypeFloat:
+      key[i] = "-1.7976931348623157e308"
+    case ColTypeDecimal:
+      key[i] = "-1e65"
+    case ColTypeTime:
+      key[i] = "1000-01-01 00:00:00"
+    default:
+      key[i] = "-9223372036854775808"
+    }
+  }
+  return key
 }
 
-func (self *Handa) ensureIndexExists(table string, columns ...string) (indexName string, isString []bool) {
+// widenColumn changes the column type. MySQL can not index long strings, so indexes on the column are dropped first.
+func (self *Handa) widenColumn(table string, tableInfo *TableInfo, column string, t int) error {
+  if t == ColTypeLongString {
+    for index := range tableInfo.indexesOf(column) {
+      if err := self.backend.DropIndex(table, index); err != nil {
+        return err
+      }
+    }
+  }
+  return self.backend.ModifyColumn(table, column, t)
+}
+
+func (self *Handa) ensureIndexExists(ctx context.Context, table string, unique bool, columns ...string) (indexName string, isString []bool, err error) {
+  if err = self.ensureTableExists(ctx, table); err != nil {
+    return
+  }
   if len(columns) == 1 && columns[0] == "serial" {
     indexName = "serial"
     isString = append(isString, false)
     return
   }
+  if err = validateIdentifiers("column", columns...); err != nil {
+    return
+  }
+  tableInfo, err := self.existingTable(table)
+  if err != nil {
+    return "", nil, err
+  }
   indexSubnames := make([]string, len(columns))
   isString = make([]bool, len(columns))
   for i, column := range columns {
     indexSubname := column
-    if self.schema[table].columnType[column] == ColTypeLongString {
+    if tableInfo.columnType[column] == ColTypeLongString {
       indexSubname = "hash_" + column
       isString[i] = true
     }
     indexSubnames[i] = indexSubname
   }
   indexName = strings.Join(indexSubnames, "$")
-  if !self.schema[table].index[indexName] { // create index
-    quotedColumns := make([]string, len(indexSubnames))
+  if !unique {
+    indexName += NonUniqueSuffix
+  }
+  if len(indexName) > MaxIdentifierLength {
+    return "", nil, &InvalidIdentifierError{"index", indexName, fmt.Sprintf("longer than %d bytes", MaxIdentifierLength)}
+  }
+  if isUnique, exists := tableInfo.index[indexName]; !exists || isUnique != unique { // create index
+    if self.isStrict(table) {
+      return "", nil, &UndeclaredError{table, "index", indexName}
+    }
     for i, t := range isString {
       if t { // ensure hash column exists
-        created := self.ensureColumnExists(table, indexSubnames[i], ColTypeHash)
+        var created bool
+        created, err = self.ensureColumnExists(ctx, table, indexSubnames[i], ColTypeHash, "")
+        if err != nil {
+          return
+        }
         if created { // update hashes
-          data, err := self.GetMap(table, "serial", columns[i])
+          var data map[string]string
+          data, err = self.GetMapContext(ctx, table, "serial", columns[i])
           if err != nil {
-            log.Fatal("get data error ", err)
+            return
+          }
+          var batch *Cursor
+          batch, err = self.BatchContext(ctx)
+          if err != nil {
+            return
           }
-          batch := self.Batch()
           for k, v := range data {
-            batch.Update(table, "serial", k, indexSubnames[i], mmh3Hex(v))
+            batch.Update(table, "serial", k, indexSubnames[i], self.hasher.Hash(v))
+          }
+          if _, err = batch.Commit(); err != nil {
+            return
           }
-          batch.Commit()
         }
       }
-      quotedColumns[i] = "`" + indexSubnames[i] + "`"
     }
-    resp := make(chan bool)
-    self.indexDDL[table] <- indexDDLReq{resp, indexName, strings.Join(quotedColumns, ",")}
-    <-resp
+    if _, err = self.requestIndexDDL(ctx, table, indexDDLReq{index: indexName, columns: indexSubnames, unique: unique}); err != nil {
+      return "", nil, err
+    }
   }
   return
 }
 
 type indexDDLReq struct {
-  resp chan bool
+  resp chan ddlResult
   index string
-  columns string
+  columns []string
+  unique bool
+  drop bool
 }
 
-func (self *Handa) startIndexDDLListener(table string) {
-  self.indexDDL[table] = make(chan indexDDLReq)
+func (self *Handa) startIndexDDLListener(table string) chan indexDDLReq {
+  reqs := make(chan indexDDLReq)
   go func() {
     for {
-      req := <-self.indexDDL[table]
-      if self.schema[table].index[req.index] {
-        req.resp <- true
+      var req indexDDLReq
+      select {
+      case req = <-reqs:
+      case <-self.quit:
+        return
+      }
+      done := func(tableInfo *TableInfo) bool {
+        if tableInfo == nil {
+          return req.drop
+        }
+        unique, exists := tableInfo.index[req.index]
+        if req.drop {
+          return !exists
+        }
+        return exists && unique == req.unique
+      }
+      if done(self.tableInfo(table)) {
+        req.resp <- ddlResult{false, nil}
         continue
       }
       //fmt.Printf("creating index %s in table %s\n", req.index, table)
-      self.withTableCacheOff(func() {
-        _, _, err := self.mysqlQuery("CREATE UNIQUE INDEX `%s` ON `%s` (%s)",
-        req.index, table, req.columns)
-        if err != nil {
-          log.Fatal("table ", table, " index creation error ", err)
+      created, err := self.runDDL(table, done, func() error {
+        if req.drop {
+          return self.backend.DropIndex(table, req.index)
         }
+        return self.backend.CreateIndex(table, req.index, req.columns, req.unique)
       })
-      self.schema[table] = self.loadTableInfo(table)
-      req.resp <- true
+      req.resp <- ddlResult{created, err}
     }
   }()
+  return reqs
 }
 
 func (self *Handa) NewCursor(isBatch bool) *Cursor {
+  return self.newCursor(context.Background(), isBatch)
+}
+
+// NewCursorContext is NewCursor bound to ctx. ctx limits the wait for a pooled
+// connection and every operation done by the cursor.
+func (self *Handa) NewCursorContext(ctx context.Context, isBatch bool) (*Cursor, error) {
+  cursor := self.newCursor(ctx, isBatch)
+  if cursor.err != nil {
+    return nil, cursor.err
+  }
+  return cursor, nil
+}
+
+func (self *Handa) newCursor(ctx context.Context, isBatch bool) *Cursor {
   cursor := &Cursor{
     isValid: true,
     handa: self,
+    ctx: ctx,
     isBatch: isBatch,
     end: make(chan bool, 1),
   }
+  self.closeMutex.RLock()
+  if self.closed {
+    self.closeMutex.RUnlock()
+    cursor.isValid = false
+    cursor.err = ErrClosed
+    return cursor
+  }
+  self.cursors.Add(1)
+  self.closeMutex.RUnlock()
   init := make(chan bool, 1)
   go func() {
-    conn := <-self.socketConnPool
-    defer func() {
-      self.socketConnPool <- conn
-    }()
+    defer self.cursors.Done()
+    conn, err := self.backend.Conn(ctx)
+    if err != nil {
+      cursor.isValid = false
+      cursor.err = err
+      init <- true
+      return
+    }
+    defer conn.Release()
     cursor.conn = conn
     if cursor.isBatch {
       cursor.conn.Batch()
     }
     init <- true
     <-cursor.end
-    cursor.isValid = false
+    if cursor.inflight != nil { // wait for the round trip abandoned by a done context
+      <-cursor.inflight
+    }
   }()
   <-init
   return cursor
@@ -432,6 +1036,10 @@ func (self *Handa) Batch() *Cursor {
   return self.NewCursor(true)
 }
 
+func (self *Handa) BatchContext(ctx context.Context) (*Cursor, error) {
+  return self.NewCursorContext(ctx, true)
+}
+
 func fatal(format string, args ...interface{}) {
   log.Fatal(fmt.Sprintf(format, args...))
 }
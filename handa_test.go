@@ -1,20 +1,47 @@
 package handa
 
 import (
+  "context"
+  "errors"
+  "flag"
   "testing"
   "time"
+  "math"
+  "math/big"
   "math/rand"
   "fmt"
   tdh "github.com/reusee/go-tdhsocket"
   "sync"
   "strconv"
   "strings"
+  "github.com/reusee/handa/memstore"
+  "github.com/reusee/handa/tdhtest"
 )
 
+var useMysql = flag.Bool("mysql", false, "run against local MySQL and TDH_Socket instead of tdhtest servers")
+
+var testConfig = Config{
+  Host: "localhost",
+  Port: "3306",
+  User: "test",
+  Password: "ffffff",
+  Database: "test",
+  TdhPort: "45678",
+}
+
 var db *Handa
 
 func TestInit(t *testing.T) {
-  db = New("localhost", "3306", "test", "ffffff", "test", "45678")
+  if !*useMysql {
+    server, err := tdhtest.NewServer(testConfig.Database)
+    if err != nil {
+      t.Fatal(err)
+    }
+    testConfig.Host = "127.0.0.1"
+    testConfig.Port = server.MysqlPort
+    testConfig.TdhPort = server.TdhPort
+  }
+  db = New(testConfig.Host, testConfig.Port, testConfig.User, testConfig.Password, testConfig.Database, testConfig.TdhPort)
   fmt.Printf("")
   rand.Seed(time.Now().UnixNano())
 }
@@ -40,7 +67,11 @@ func TestInsert(t *testing.T) {
     if err == nil {
       t.Fail()
     }
-    if err.(*tdh.Error).ClientStatus != 502 || err.(*tdh.Error).ErrorCode != 121 {
+    if !errors.Is(err, ErrDuplicateKey) {
+      t.Fail()
+    }
+    var tdhErr *tdh.Error
+    if !errors.As(err, &tdhErr) || tdhErr.ClientStatus != 502 || tdhErr.ErrorCode != 121 {
       t.Fail()
     }
   }
@@ -636,3 +667,1757 @@ func TestConcurrentDDL(t *testing.T) {
     t.Fatal("insert error")
   }
 }
+
+func TestColumnWidening(t *testing.T) {
+  table := fmt.Sprintf("test_%d", rand.Int63())
+  if err := db.Insert(table, "id", 1, "n", true); err != nil {
+    t.Fatal(err)
+  }
+  if err := db.Insert(table, "id", 2, "n", 5); err != nil {
+    t.Fatal(err)
+  }
+  if err := db.Insert(table, "id", 3, "n", 2.5); err != nil {
+    t.Fatal(err)
+  }
+  m, err := db.GetMap(table, "id", "n")
+  if err != nil || m["1"] != "1" || m["2"] != "5" || m["3"] != "2.5" {
+    t.Fatal("widen number", m, err)
+  }
+
+  table = fmt.Sprintf("test_%d", rand.Int63())
+  if err := db.Insert(table, "id", 1, "n", 5); err != nil {
+    t.Fatal(err)
+  }
+  if err := db.Insert(table, "id", 2, "n", big.NewRat(1, 4)); err != nil {
+    t.Fatal(err)
+  }
+  m, err = db.GetMap(table, "id", "n")
+  if err != nil {
+    t.Fatal(err)
+  }
+  for id, n := range map[string]*big.Rat{"1": big.NewRat(5, 1), "2": big.NewRat(1, 4)} {
+    if d, err := ParseDecimal(m[id]); err != nil || d.Cmp(n) != 0 {
+      t.Fatal("widen to decimal", m, err)
+    }
+  }
+  if info, err := db.backend.LoadTable(table); err != nil || info.columnType["n"] != ColTypeDecimal {
+    t.Fatal("decimal column", info, err)
+  }
+
+  table = fmt.Sprintf("test_%d", rand.Int63())
+  if err := db.Insert(table, "name", "short", "id", 4); err != nil {
+    t.Fatal(err)
+  }
+  long := strings.Repeat("long", 100)
+  if err := db.Insert(table, "name", long, "id", 5); err != nil {
+    t.Fatal(err)
+  }
+  info, err := db.backend.LoadTable(table)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if info.columnType["name"] != ColTypeLongString || !info.index["hash_name"] || info.index["name"] {
+    t.Fatal("widen string", info)
+  }
+  for _, name := range []string{"short", long} {
+    col, err := db.GetFilteredCol(table, "name, id", "name=" + name)
+    if err != nil || len(col) != 1 {
+      t.Fatal("get by widened index", col, err)
+    }
+  }
+  if err := db.Insert(table, "name", "short", "id", 6); !errors.Is(err, ErrDuplicateKey) {
+    t.Fatal("should be duplicated", err)
+  }
+}
+
+func TestConvertToString(t *testing.T) {
+  n := 42
+  ts := time.Date(2013, 1, 2, 3, 4, 5, 6000, time.FixedZone("CST", 8 * 3600))
+  cases := []struct {
+    in interface{}
+    out string
+    t int
+  }{
+    {uint16(65535), "65535", ColTypeInt},
+    {uint(1), "1", ColTypeUint},
+    {uint64(math.MaxUint64), "18446744073709551615", ColTypeUint},
+    {1e-9, "1e-09", ColTypeFloat},
+    {float32(0.1), "0.1", ColTypeFloat},
+    {math.MaxFloat64, "1.7976931348623157e+308", ColTypeFloat},
+    {time.Second, "1000000000", ColTypeInt},
+    {ts, "2013-01-01 19:04:05.000006", ColTypeTime},
+    {big.NewInt(-12345), "-12345", ColTypeDecimal},
+    {big.NewRat(1, 4), "0.25", ColTypeDecimal},
+    {big.NewFloat(2.5), "2.5", ColTypeDecimal},
+    {&n, "42", ColTypeInt},
+  }
+  for _, c := range cases {
+    out, typ, err := convertToString(c.in)
+    if err != nil || out != c.out || typ != c.t {
+      t.Fatalf("convert %v: got %s %d %v", c.in, out, typ, err)
+    }
+  }
+  // nil pointers are zero values
+  var nilPtr *int
+  if out, typ, err := convertToString(nilPtr); err != nil || out != "0" || typ != ColTypeInt {
+    t.Fatal("nil pointer", out, typ, err)
+  }
+  var nilStr **string
+  if out, typ, err := convertToString(nilStr); err != nil || out != "" || typ != ColTypeString {
+    t.Fatal("nil pointer", out, typ, err)
+  }
+  var nilRat *big.Rat
+  if out, typ, err := convertToString(nilRat); err != nil || out != "0" || typ != ColTypeDecimal {
+    t.Fatal("nil pointer", out, typ, err)
+  }
+  var nilChan *chan int
+  if _, _, err := convertToString(nilChan); !errors.Is(err, ErrUnsupportedType) {
+    t.Fatal("nil pointer", err)
+  }
+  maxInt, _ := new(big.Int).SetString(strings.Repeat("9", 35), 10)
+  if _, typ, err := convertToString(maxInt); err != nil || typ != ColTypeDecimal {
+    t.Fatal("max decimal", typ, err)
+  }
+  for _, v := range []interface{}{
+    new(big.Int).Add(maxInt, big.NewInt(1)),
+    new(big.Int).Neg(new(big.Int).Add(maxInt, big.NewInt(1))),
+    new(big.Rat).SetFrac(new(big.Int).Mul(maxInt, big.NewInt(10)), big.NewInt(3)),
+    new(big.Float).SetInt(new(big.Int).Add(maxInt, big.NewInt(1))),
+  } {
+    if _, _, err := convertToString(v); !errors.Is(err, ErrUnsupportedType) {
+      t.Fatal("out of decimal range", v, err)
+    }
+  }
+  parsed, err := ParseTime("2013-01-01 19:04:05.000006")
+  if err != nil || !parsed.Equal(ts) {
+    t.Fatal("parse time", parsed, err)
+  }
+}
+
+func TestTimeAndDecimal(t *testing.T) {
+  table := fmt.Sprintf("test_%d", rand.Int63())
+  now := time.Now()
+  price, _ := new(big.Rat).SetString("12345678901234567890.123456789")
+  if err := db.Insert(table, "id", 1, "created,price", now, price); err != nil {
+    t.Fatal(err)
+  }
+  m, err := db.GetMultiMap(table, "id", "created,price")
+  if err != nil {
+    t.Fatal(err)
+  }
+  created, err := ParseTime(m["1"][0])
+  if err != nil || !created.Equal(now.Truncate(time.Microsecond)) {
+    t.Fatal("time", m["1"][0], err)
+  }
+  p, err := ParseDecimal(m["1"][1])
+  if err != nil || p.Cmp(price) != 0 {
+    t.Fatal("decimal", m["1"][1], err)
+  }
+  col, err := db.GetFilteredCol(table, "id", "created>=" + now.Add(-time.Second).UTC().Format(TimeFormat))
+  if err != nil || len(col) != 1 {
+    t.Fatal("filter by time", col, err)
+  }
+}
+
+func TestUnsigned(t *testing.T) {
+  table := fmt.Sprintf("test_%d", rand.Int63())
+  for _, id := range []uint64{0, 1, math.MaxInt64 + 1, math.MaxUint64} {
+    if err := db.Insert(table, "id", id, "f", float64(id) / 3); err != nil {
+      t.Fatal(err)
+    }
+  }
+  col, err := db.GetCol(table, "id")
+  if err != nil || len(col) != 4 || col[0] != "0" || col[3] != "18446744073709551615" {
+    t.Fatal("get unsigned index", col, err)
+  }
+  m, err := db.GetFilteredMap(table, "id", "f", "id>9223372036854775807")
+  if err != nil || len(m) != 2 {
+    t.Fatal("filter unsigned index", m, err)
+  }
+  if f, _ := strconv.ParseFloat(m["18446744073709551615"], 64); f != float64(uint64(math.MaxUint64)) / 3 {
+    t.Fatal("float not exact", m)
+  }
+
+  // mixed signed and unsigned values, in both orders
+  for _, values := range [][]interface{}{
+    {-1, uint64(math.MaxUint64)},
+    {uint64(math.MaxUint64), -1},
+  } {
+    table := fmt.Sprintf("test_%d", rand.Int63())
+    for i, v := range values {
+      if err := db.Insert(table, "id", i, "n", v); err != nil {
+        t.Fatal(err)
+      }
+    }
+    if info, err := db.backend.LoadTable(table); err != nil || info.columnType["n"] != ColTypeDecimal {
+      t.Fatal("mixed column", values, info, err)
+    }
+    m, err := db.GetMap(table, "id", "n")
+    if err != nil {
+      t.Fatal(err)
+    }
+    for i, v := range values {
+      d, err := ParseDecimal(m[strconv.Itoa(i)])
+      if err != nil || d.String() != fmt.Sprintf("%d/1", v) {
+        t.Fatal("mixed value", m, err)
+      }
+    }
+  }
+}
+
+func TestParseColumn(t *testing.T) {
+  cases := []struct {
+    sqlType string
+    t int
+    base string
+    length int
+    scale int
+    unsigned bool
+  }{
+    {"tinyint(1)", ColTypeBool, "tinyint", 1, 0, false},
+    {"bigint(255)", ColTypeInt, "bigint", 255, 0, false},
+    {"int(11)", ColTypeInt, "int", 11, 0, false},
+    {"bigint", ColTypeInt, "bigint", 0, 0, false},
+    {"bigint(20) unsigned", ColTypeUint, "bigint", 20, 0, true},
+    {"int unsigned", ColTypeUint, "int", 0, 0, true},
+    {"double", ColTypeFloat, "double", 0, 0, false},
+    {"decimal(10,2)", ColTypeDecimal, "decimal", 10, 2, false},
+    {"varchar(64)", ColTypeString, "varchar", 64, 0, false},
+    {"char(32)", ColTypeString, "char", 32, 0, false},
+    {"text", ColTypeLongString, "text", 0, 0, false},
+    {"longblob", ColTypeLongString, "longblob", 0, 0, false},
+    {"datetime", ColTypeTime, "datetime", 0, 0, false},
+    {"datetime(6)", ColTypeTime, "datetime", 6, 0, false},
+    {"enum('a','b')", ColTypeUnknown, "enum", 0, 0, false},
+    {"date", ColTypeUnknown, "date", 0, 0, false},
+  }
+  for _, c := range cases {
+    column := parseColumn("c", c.sqlType, true, nil)
+    if column.Type != c.t || column.BaseType != c.base || column.Length != c.length ||
+    column.Scale != c.scale || column.Unsigned != c.unsigned {
+      t.Fatalf("parse %s: %+v", c.sqlType, column)
+    }
+  }
+  if column := parseColumn("hash_c", "char(32)", true, nil); column.Type != ColTypeHash {
+    t.Fatalf("hash column: %+v", column)
+  }
+}
+
+func TestLegacyTable(t *testing.T) {
+  backend := NewMemoryBackend()
+  err := backend.(*memoryBackend).store.Do(func(tx *memstore.Tx) error {
+    tx.CreateTable("legacy")
+    tx.AddColumn("legacy", "age", "int(11)", "0")
+    tx.AddColumn("legacy", "name", "varchar(64)", "")
+    tx.AddColumn("legacy", "created", "datetime", "")
+    tx.AddColumn("legacy", "kind", "enum('a','b')", "a")
+    return tx.CreateIndex("legacy", "name", []string{"name"}, true)
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  h, err := NewWithConfig(Config{
+    Backend: backend,
+    Strict: true, // no DDL
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  if err := h.Insert("legacy", "name", "foo", "age,created,kind", 3, time.Now(), "b"); err != nil {
+    t.Fatal(err)
+  }
+  m, err := h.GetMultiMap("legacy", "name", "age,kind")
+  if err != nil || m["foo"][0] != "3" || m["foo"][1] != "b" {
+    t.Fatal("get", m, err)
+  }
+}
+
+func TestNarrowColumns(t *testing.T) {
+  backend := NewMemoryBackend()
+  err := backend.(*memoryBackend).store.Do(func(tx *memstore.Tx) error {
+    for _, table := range []string{"legacy", "strict"} {
+      tx.CreateTable(table)
+      tx.AddColumn(table, "age", "int(11)", "0")
+      tx.AddColumn(table, "level", "tinyint(4) unsigned", "0")
+      tx.AddColumn(table, "name", "varchar(64)", "")
+      tx.AddColumn(table, "code", "char(32)", "")
+      tx.AddColumn(table, "price", "decimal(10,2)", "0")
+      tx.AddColumn(table, "bio", "tinytext", "")
+    }
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  h, err := NewWithConfig(Config{
+    Backend: backend,
+    Schema: []TableDef{{Name: "strict", Strict: true}},
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+
+  // values fitting are stored as is
+  if err := h.Insert("legacy", "serial", 1, "age,level,name,code,price,bio", -5, 200, "foo", "bar", big.NewRat(1, 4), "bio"); err != nil {
+    t.Fatal(err)
+  }
+  info, err := backend.LoadTable("legacy")
+  if err != nil {
+    t.Fatal(err)
+  }
+  for column, sqlType := range map[string]string{"age": "int(11)", "level": "tinyint(4) unsigned", "name": "varchar(64)",
+  "code": "char(32)", "price": "decimal(10,2)", "bio": "tinytext"} {
+    if info.columns[column].SQLType != sqlType {
+      t.Fatal("should not widen", column, info.columns[column].SQLType)
+    }
+  }
+  if info.columnType["code"] != ColTypeString {
+    t.Fatal("not a hash column", info.columnType["code"])
+  }
+
+  // values overflowing are stored in wider columns
+  long := strings.Repeat("x", 100)
+  if err := h.Insert("legacy", "serial", 2, "age,level,name,code,price,bio", int64(1) << 40, 300, long, long,
+  big.NewRat(1, 1000), strings.Repeat("x", 300)); err != nil {
+    t.Fatal(err)
+  }
+  info, err = backend.LoadTable("legacy")
+  if err != nil {
+    t.Fatal(err)
+  }
+  for column, sqlType := range map[string]string{"age": "bigint(255)", "level": "bigint(255) unsigned", "name": "varchar(255)",
+  "code": "varchar(255)", "price": "decimal(65,30)", "bio": "longtext"} {
+    if info.columns[column].SQLType != sqlType {
+      t.Fatal("should widen", column, info.columns[column].SQLType)
+    }
+  }
+  row, err := h.GetMultiMap("legacy", "serial", "age,name,price")
+  if err != nil || row["2"][0] != "1099511627776" || row["2"][1] != long {
+    t.Fatal("get", row, err)
+  }
+  if d, err := ParseDecimal(row["2"][2]); err != nil || d.Cmp(big.NewRat(1, 1000)) != 0 {
+    t.Fatal("decimal", row["2"][2], err)
+  }
+
+  // or rejected in strict tables
+  if err := h.Insert("strict", "serial", 1, "name", long); !errors.As(err, new(*UndeclaredError)) {
+    t.Fatal("should be rejected", err)
+  }
+  if err := h.Insert("strict", "serial", 1, "age", int64(1) << 40); !errors.As(err, new(*UndeclaredError)) {
+    t.Fatal("should be rejected", err)
+  }
+}
+
+func TestNewWithConfigError(t *testing.T) {
+  _, err := NewWithConfig(Config{
+    Host: "127.0.0.1",
+    Port: "1",
+    User: "test",
+    Database: "test",
+    TdhPort: "1",
+    MysqlConnPoolSize: 1,
+    SocketConnPoolSize: 1,
+    DialTimeout: time.Second,
+  })
+  if err == nil {
+    t.Fatal("should fail")
+  }
+}
+
+func TestClose(t *testing.T) {
+  config := testConfig
+  config.MysqlConnPoolSize = 2
+  config.SocketConnPoolSize = 2
+  h, err := NewWithConfig(config)
+  if err != nil {
+    t.Fatal(err)
+  }
+  c := h.Batch()
+  c.Insert("thread", "tid", rand.Int63(), "subject", "insert before close")
+  go c.Commit()
+  if err := h.Close(context.Background()); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.Insert("thread", "tid", rand.Int63(), "subject", "insert after close"); err != ErrClosed {
+    t.Fatal("should fail after close")
+  }
+  if err := h.Close(context.Background()); err != ErrClosed {
+    t.Fatal("close twice")
+  }
+}
+
+func TestContextTimeout(t *testing.T) {
+  config := testConfig
+  config.MysqlConnPoolSize = 1
+  config.SocketConnPoolSize = 1
+  h, err := NewWithConfig(config)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  c := h.Batch() // hold the only connection
+  ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+  defer cancel()
+  err = h.InsertContext(ctx, "thread", "tid", rand.Int63(), "subject", "timeout")
+  if err != context.DeadlineExceeded {
+    t.Fatal("should time out", err)
+  }
+  c.Commit()
+  err = h.InsertContext(context.Background(), "thread", "tid", rand.Int63(), "subject", "no timeout")
+  if err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestTypedErrors(t *testing.T) {
+  err := db.Insert("thread", "tid, time", []interface{}{1}, "")
+  if err != ErrKeyCountMismatch {
+    t.Fatal("key count mismatch", err)
+  }
+  err = db.Insert("thread", "tid", rand.Int63(), "subject", struct{}{})
+  if !errors.Is(err, ErrUnsupportedType) {
+    t.Fatal("unsupported type", err)
+  }
+  err = db.Insert("thread", "tid", rand.Int63(), "subject, board", "no board")
+  if err != ErrFieldCountMismatch {
+    t.Fatal("field count mismatch", err)
+  }
+  for _, filter := range []string{"tid", ""} {
+    if _, err := db.GetFilteredCol("thread", "tid", filter); !errors.Is(err, ErrInvalidFilter) {
+      t.Fatal("invalid filter", filter, err)
+    }
+  }
+  c := db.Batch()
+  if _, err := c.GetCol("thread", "tid"); err != ErrBatchNotPermitted {
+    t.Fatal("batch not permitted", err)
+  }
+  c.Commit()
+  c = db.NewCursor(false)
+  c.GetCol("thread", "tid")
+  if _, err := c.GetCol("thread", "tid"); err != ErrInvalidCursor {
+    t.Fatal("invalid cursor", err)
+  }
+}
+
+func TestSQLBackend(t *testing.T) {
+  if !*useMysql {
+    t.Skip("tdhtest only understands the statements of the tdh backend")
+  }
+  config := testConfig
+  config.MysqlConnPoolSize = 4
+  config.Driver = DriverSQL
+  h, err := NewWithConfig(config)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  table := fmt.Sprintf("test_%d", rand.Int63())
+  for i := 0; i < 10; i++ {
+    if err := h.Insert(table, "i", i, "s,f", strings.Repeat("s", i), float64(i) / 2); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := h.Insert(table, "i", 3, "s", "dup"); !errors.Is(err, ErrDuplicateKey) {
+    t.Fatal("should be duplicated", err)
+  }
+  if err := h.InsertUpdate(table, "i", 3, "s", "updated"); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.UpdateInsert(table, "i", 20, "s", "inserted"); err != nil {
+    t.Fatal(err)
+  }
+  count, change, err := h.Update(table, "i", 4, "f", 100.5)
+  if err != nil || count != 1 || change != 1 {
+    t.Fatal("update", count, change, err)
+  }
+  m, err := h.GetRangedFilteredMap(table, "i", "s", 0, 3, "i>2")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(m) != 3 || m["3"] != "updated" || m["4"] != "ssss" || m["5"] != "sssss" {
+    t.Fatal("get", m)
+  }
+  b := h.Batch()
+  b.Insert(table, "i", 30, "s", "batch")
+  b.Update(table, "i", 20, "s", "batch updated")
+  res, err := b.Commit()
+  if err != nil || len(res) != 2 || res[1].Count != 1 {
+    t.Fatal("batch", res, err)
+  }
+  longText := strings.Repeat("long", 100)
+  if err := h.Insert(table, "text", longText, "i", 40); err != nil {
+    t.Fatal(err)
+  }
+  col, err := h.GetFilteredCol(table, "text, i", "text=" + longText)
+  if err != nil || len(col) != 1 || col[0] != "40" {
+    t.Fatal("text index", col, err)
+  }
+}
+
+func TestMemoryBackend(t *testing.T) {
+  h, err := NewWithConfig(Config{
+    Driver: DriverMemory,
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  table := "foo"
+  for i := 0; i < 10; i++ {
+    if err := h.Insert(table, "i", i, "s,f", strings.Repeat("s", i), float64(i) / 2); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := h.Insert(table, "i", 3, "s", "dup"); !errors.Is(err, ErrDuplicateKey) {
+    t.Fatal("should be duplicated", err)
+  }
+  if err := h.InsertUpdate(table, "i", 3, "s", "updated"); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.UpdateInsert(table, "i", 20, "s", "inserted"); err != nil {
+    t.Fatal(err)
+  }
+  count, change, err := h.Update(table, "i", 4, "f", 100.5)
+  if err != nil || count != 1 || change != 1 {
+    t.Fatal("update", count, change, err)
+  }
+  m, err := h.GetRangedFilteredMap(table, "i", "s", 0, 3, "i>2")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(m) != 3 || m["3"] != "updated" || m["4"] != "ssss" || m["5"] != "sssss" {
+    t.Fatal("get", m)
+  }
+  m, err = h.GetFilteredMap(table, "i", "f", "f>=4", "i<9")
+  if err != nil || len(m) != 2 || m["4"] != "100.5" || m["8"] != "4" {
+    t.Fatal("filter", m, err)
+  }
+
+  // batch
+  b := h.Batch()
+  b.Insert(table, "i", 30, "s", "batch")
+  b.Update(table, "i", 20, "s", "batch updated")
+  res, err := b.Commit()
+  if err != nil || len(res) != 2 || res[0].T != tdh.INSERT || res[1].Count != 1 {
+    t.Fatal("batch", res, err)
+  }
+  b = h.Batch()
+  b.Insert(table, "i", 31, "s", "batch")
+  b.Insert(table, "i", 30, "s", "batch")
+  if _, err := b.Commit(); !errors.Is(err, ErrDuplicateKey) {
+    t.Fatal("batch should fail", err)
+  }
+  if col, err := h.GetFilteredCol(table, "i", "i=31"); err != nil || len(col) != 0 {
+    t.Fatal("batch should be rolled back", col, err)
+  }
+
+  // text index
+  table = "text"
+  longText := strings.Repeat("long", 100)
+  if err := h.Insert(table, "text", longText, "i", 40); err != nil {
+    t.Fatal(err)
+  }
+  col, err := h.GetFilteredCol(table, "text, i", "text=" + longText)
+  if err != nil || len(col) != 1 || col[0] != "40" {
+    t.Fatal("text index", col, err)
+  }
+
+  // multi-column index
+  table = "multi"
+  if err := h.Insert(table, "a,b", []interface{}{1, "x"}, "i", 50); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.Insert(table, "a,b", []interface{}{1, "y"}, "i", 51); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.Insert(table, "a,b", []interface{}{1, "x"}, "i", 52); !errors.Is(err, ErrDuplicateKey) {
+    t.Fatal("should be duplicated", err)
+  }
+  m, err = h.GetFilteredMap(table, "a$b, b", "i", "a=1")
+  if err != nil || len(m) != 2 || m["x"] != "50" || m["y"] != "51" {
+    t.Fatal("multi-column index", m, err)
+  }
+}
+
+func TestStrictSchema(t *testing.T) {
+  h, err := NewWithConfig(Config{
+    Driver: DriverMemory,
+    Schema: []TableDef{
+      {
+        Name: "user",
+        Columns: []ColumnDef{
+          {"uid", ColTypeInt},
+          {"name", ColTypeString},
+          {"bio", ColTypeLongString},
+        },
+        Indexes: [][]string{{"uid"}, {"bio"}},
+        Strict: true,
+      },
+      {
+        Name: "log",
+      },
+    },
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  info, err := h.backend.LoadTable("user")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if info.columnType["bio"] != ColTypeLongString || info.columnType["hash_bio"] != ColTypeHash ||
+  !info.index["uid"] || !info.index["hash_bio"] {
+    t.Fatal("schema not applied", info)
+  }
+  if err := h.Insert("user", "uid", 1, "name,bio", "foo", strings.Repeat("bio", 100)); err != nil {
+    t.Fatal(err)
+  }
+  m, err := h.GetFilteredMap("user", "bio", "uid", "bio=" + strings.Repeat("bio", 100))
+  if err != nil || len(m) != 1 {
+    t.Fatal("get by declared index", m, err)
+  }
+  var undeclared *UndeclaredError
+  err = h.Insert("user", "uid", 2, "nmae", "typo")
+  if !errors.Is(err, ErrUndeclared) || !errors.As(err, &undeclared) || undeclared.Kind != "column" || undeclared.Name != "nmae" {
+    t.Fatal("undeclared column", err)
+  }
+  err = h.Insert("user", "name", "foo", "uid", 3)
+  if !errors.As(err, &undeclared) || undeclared.Kind != "index" {
+    t.Fatal("undeclared index", err)
+  }
+  err = h.Insert("user", "uid", 4, "name", strings.Repeat("name", 100))
+  if !errors.As(err, &undeclared) || undeclared.Kind != "wider column" {
+    t.Fatal("undeclared widening", err)
+  }
+  // not strict
+  if err := h.Insert("log", "id", 1, "msg", "ok"); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.Insert("undeclared", "id", 1, ""); err != nil {
+    t.Fatal(err)
+  }
+
+  // global
+  h, err = NewWithConfig(Config{
+    Driver: DriverMemory,
+    Schema: []TableDef{
+      {Name: "log", Columns: []ColumnDef{{"msg", ColTypeString}}},
+    },
+    Strict: true,
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  if err := h.Insert("log", "serial", 1, "msg", "ok"); err != nil {
+    t.Fatal(err)
+  }
+  err = h.Insert("undeclared", "id", 1, "")
+  if !errors.As(err, &undeclared) || undeclared.Kind != "table" {
+    t.Fatal("undeclared table", err)
+  }
+}
+
+func TestConcurrentSchema(t *testing.T) {
+  h, err := NewWithConfig(Config{
+    Driver: DriverMemory,
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  wg := new(sync.WaitGroup)
+  errs := make(chan error, 1)
+  for i := 0; i < 4; i++ {
+    table := fmt.Sprintf("table_%d", i)
+    for j := 0; j < 8; j++ {
+      column := fmt.Sprintf("c%d", j)
+      j := j
+      wg.Add(2)
+      go func() {
+        defer wg.Done()
+        if err := h.Insert(table, "k", j, column, strings.Repeat("s", j)); err != nil {
+          errs <- err
+        }
+      }()
+      go func() {
+        defer wg.Done()
+        if _, err := h.GetCol(table, "serial"); err != nil {
+          errs <- err
+        }
+      }()
+    }
+  }
+  wg.Wait()
+  close(errs)
+  for err := range errs {
+    t.Fatal(err)
+  }
+  for i := 0; i < 4; i++ {
+    rows, err := h.GetCol(fmt.Sprintf("table_%d", i), "serial")
+    if err != nil || len(rows) != 8 {
+      t.Fatal("rows", rows, err)
+    }
+  }
+}
+
+func TestIntrospection(t *testing.T) {
+  backend := NewMemoryBackend()
+  h, err := NewWithConfig(Config{
+    Backend: backend,
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  if err := h.Insert("foo", "a, b", []interface{}{1, strings.Repeat("b", 1024)}, "c", 1.5); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := h.GetCol("foo", "a"); err != nil {
+    t.Fatal(err)
+  }
+  if tables := h.Tables(); len(tables) != 1 || tables[0] != "foo" {
+    t.Fatal("tables", tables)
+  }
+  if _, ok := h.Table("bar"); ok {
+    t.Fatal("should not exist")
+  }
+  table, ok := h.Table("foo")
+  if !ok {
+    t.Fatal("should exist")
+  }
+  columns := make(map[string]ColumnSchema)
+  for _, column := range table.Columns {
+    columns[column.Name] = column
+  }
+  if len(columns) != 4 || columns["a"].Type != ColTypeInt || columns["c"].Type != ColTypeFloat {
+    t.Fatal("columns", table.Columns)
+  }
+  if b := columns["b"]; b.Type != ColTypeLongString || b.HashColumn != "hash_b" {
+    t.Fatal("hash column", b)
+  }
+  indexes := make(map[string][]string)
+  for _, index := range table.Indexes {
+    indexes[index.Name] = index.Columns
+  }
+  if len(indexes) != 3 || len(indexes["a"]) != 1 ||
+    len(indexes["a$hash_b"]) != 2 || indexes["a$hash_b"][1] != "b" {
+    t.Fatal("indexes", table.Indexes)
+  }
+
+  // changes by others are seen after reload
+  err = backend.(*memoryBackend).store.Do(func(tx *memstore.Tx) error {
+    if err := tx.CreateTable("bar"); err != nil {
+      return err
+    }
+    return tx.AddColumn("foo", "d", "VARCHAR(255)", "")
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := h.Reload("foo"); err != nil {
+    t.Fatal(err)
+  }
+  if table, _ := h.Table("foo"); len(table.Columns) != 5 || table.Columns[4].Type != ColTypeString {
+    t.Fatal("reload table", table.Columns)
+  }
+  if err := h.Reload(); err != nil {
+    t.Fatal(err)
+  }
+  if tables := h.Tables(); len(tables) != 1 {
+    t.Fatal("bar should not be loaded", tables)
+  }
+  if _, ok := h.Table("bar"); !ok {
+    t.Fatal("bar should be loaded when asked")
+  }
+  err = backend.(*memoryBackend).store.Do(func(tx *memstore.Tx) error {
+    return tx.DropTable("bar")
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := h.Reload("bar"); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.Reload(); err != nil {
+    t.Fatal(err)
+  }
+  if tables := h.Tables(); len(tables) != 1 || tables[0] != "foo" {
+    t.Fatal("dropped table should be forgotten", tables)
+  }
+}
+
+func TestLazyLoading(t *testing.T) {
+  backend := NewMemoryBackend()
+  err := backend.(*memoryBackend).store.Do(func(tx *memstore.Tx) error {
+    for _, table := range []string{"a", "b", "c"} {
+      if err := tx.CreateTable(table); err != nil {
+        return err
+      }
+      if err := tx.AddColumn(table, "name", "VARCHAR(255)", ""); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  h, err := NewWithConfig(Config{
+    Backend: backend,
+    Preload: []string{"a", "not_exists"},
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  if tables := h.Tables(); len(tables) != 1 || tables[0] != "a" {
+    t.Fatal("preload", tables)
+  }
+  if err := h.Insert("b", "name", "foo", ""); err != nil {
+    t.Fatal(err)
+  }
+  if tables := h.Tables(); len(tables) != 2 || tables[1] != "b" {
+    t.Fatal("lazy load", tables)
+  }
+  if table, _ := h.Table("b"); len(table.Indexes) != 2 {
+    t.Fatal("index not created", table.Indexes)
+  }
+
+  // existing tables are loaded without the table DDL listener
+  busy := tableDDLReq{table: "a", resp: make(chan ddlResult)}
+  h.tableDDL <- busy // blocks the listener on replying
+  if err := h.Insert("c", "name", "foo", ""); err != nil {
+    t.Fatal("load while listener busy", err)
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+  defer cancel()
+  if err := h.InsertContext(ctx, "d", "name", "foo", ""); err != context.DeadlineExceeded {
+    t.Fatal("create should wait for listener", err)
+  }
+  <-busy.resp
+}
+
+func TestStaleSchemaRecovery(t *testing.T) {
+  table := fmt.Sprintf("test_%d", rand.Int63())
+  if err := db.Insert(table, "a", 1, ""); err != nil {
+    t.Fatal(err)
+  }
+  h, err := NewWithConfig(testConfig)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  if _, ok := h.Table(table); !ok {
+    t.Fatal("table not loaded")
+  }
+
+  // column and index created by another process after loaded
+  if err := db.Insert(table, "a", 2, "b", "foo"); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := db.GetCol(table, "b"); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.Insert(table, "a", 3, "b", "bar"); err != nil {
+    t.Fatal("column", err)
+  }
+  rows, err := h.GetCol(table, "b")
+  if err != nil || len(rows) != 3 {
+    t.Fatal("index", rows, err)
+  }
+}
+
+func TestSchemaPolling(t *testing.T) {
+  table := fmt.Sprintf("test_%d", rand.Int63())
+  if err := db.Insert(table, "a", 1, ""); err != nil {
+    t.Fatal(err)
+  }
+  config := testConfig
+  config.Preload = []string{table}
+  config.SchemaPollInterval = time.Millisecond * 10
+  h, err := NewWithConfig(config)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  if err := db.Insert(table, "a", 2, "b", 1); err != nil {
+    t.Fatal(err)
+  }
+  for i := 0; ; i++ {
+    schema, _ := h.Table(table)
+    if len(schema.Columns) == 3 {
+      break
+    }
+    if i == 100 {
+      t.Fatal("not reloaded", schema.Columns)
+    }
+    time.Sleep(time.Millisecond * 10)
+  }
+}
+
+func TestDDLLock(t *testing.T) {
+  table := fmt.Sprintf("test_%d", rand.Int63())
+  if err := db.Insert(table, "a", 1, ""); err != nil {
+    t.Fatal(err)
+  }
+  config := testConfig
+  config.Preload = []string{table}
+  config.DDLLockTimeout = time.Second
+  h, err := NewWithConfig(config)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+
+  // both add the same columns
+  wg := new(sync.WaitGroup)
+  errs := make(chan error, 20)
+  for i := 0; i < 10; i++ {
+    column := fmt.Sprintf("c%d", i)
+    for _, handa := range []*Handa{db, h} {
+      handa := handa
+      wg.Add(1)
+      go func() {
+        defer wg.Done()
+        if _, _, err := handa.Update(table, "a", 1, column, 1); err != nil {
+          errs <- err
+        }
+      }()
+    }
+  }
+  wg.Wait()
+  close(errs)
+  for err := range errs {
+    t.Fatal(err)
+  }
+  stats := h.DDLStats()
+  if stats.Locks == 0 || stats.Statements + stats.Skipped < stats.Locks {
+    t.Fatal("stats", stats)
+  }
+
+  // lock held by others
+  unlock, err := db.backend.(DDLLocker).LockDDL(table, time.Second)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer unlock()
+  err = h.Insert(table, "a", 2, "b", 1)
+  var timeoutErr *DDLLockTimeoutError
+  if !errors.Is(err, ErrDDLLockTimeout) || !errors.As(err, &timeoutErr) || timeoutErr.Table != table {
+    t.Fatal("should time out", err)
+  }
+  if stats := h.DDLStats(); stats.LockTimeouts != 1 || stats.LockWait < time.Second {
+    t.Fatal("stats", stats)
+  }
+}
+
+func TestTdhDDLModes(t *testing.T) {
+  config := testConfig
+  config.TdhDDL = "unknown"
+  if _, err := NewWithConfig(config); err == nil {
+    t.Fatal("should fail")
+  }
+
+  config.TdhDDL = TdhDDLFlush
+  h, err := NewWithConfig(config)
+  if err != nil {
+    t.Fatal(err)
+  }
+  table := fmt.Sprintf("test_%d", rand.Int63())
+  if err := h.Insert(table, "a", 1, "b", "foo"); err != nil {
+    t.Fatal(err)
+  }
+  h.Close(context.Background())
+
+  config.TdhDDL = TdhDDLForbidden
+  h, err = NewWithConfig(config)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  if err := h.Insert(table, "a", 2, "b", "bar"); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.Insert(table, "a", 3, "c", "bar"); !errors.Is(err, ErrDDLForbidden) {
+    t.Fatal("column", err)
+  }
+  if err := h.Insert(fmt.Sprintf("test_%d", rand.Int63()), "a", 1, ""); !errors.Is(err, ErrDDLForbidden) {
+    t.Fatal("table", err)
+  }
+}
+
+func TestNonUniqueIndex(t *testing.T) {
+  table := fmt.Sprintf("test_%d", rand.Int63())
+  cities := []string{"beijing", "shanghai", "beijing", "guangzhou", "beijing"}
+  for i, city := range cities {
+    if err := db.Insert(table, "id", i, "city,population", city, i * 100); err != nil {
+      t.Fatal(err)
+    }
+  }
+  var ddlErr *DDLError
+  if _, err := db.GetFilteredCol(table, "city", "city=beijing"); !errors.As(err, &ddlErr) {
+    t.Fatal("unique index on duplicated values", err)
+  }
+  cols, err := db.GetFilteredCol(table, "city" + NonUniqueSuffix, "city=beijing")
+  if err != nil || len(cols) != 3 {
+    t.Fatal("equal", cols, err)
+  }
+  cols, err = db.GetFilteredCol(table, "city" + NonUniqueSuffix, "city>c")
+  if err != nil || len(cols) != 2 || cols[0] != "guangzhou" || cols[1] != "shanghai" {
+    t.Fatal("range", cols, err)
+  }
+  m, err := db.GetFilteredMap(table, "population" + NonUniqueSuffix, "city", "population>=200")
+  if err != nil || len(m) != 3 || m["400"] != "beijing" {
+    t.Fatal("map", m, err)
+  }
+  schema, _ := db.Table(table)
+  for _, index := range schema.Indexes {
+    if index.Name == "city" + NonUniqueSuffix && (index.Unique || index.Columns[0] != "city") {
+      t.Fatal("schema", index)
+    }
+  }
+
+  // declared
+  h, err := NewWithConfig(Config{
+    Driver: DriverMemory,
+    Schema: []TableDef{
+      {
+        Name: "foo",
+        Columns: []ColumnDef{{"tag", ColTypeString}},
+        NonUniqueIndexes: [][]string{{"tag"}},
+        Strict: true,
+      },
+    },
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  for i := 0; i < 3; i++ {
+    if err := h.Insert("foo", "serial", i + 1, "tag", "a"); err != nil {
+      t.Fatal(err)
+    }
+  }
+  cols, err = h.GetFilteredCol("foo", "tag" + NonUniqueSuffix, "tag=a")
+  if err != nil || len(cols) != 3 {
+    t.Fatal("declared", cols, err)
+  }
+}
+
+func TestAlterSchema(t *testing.T) {
+  table := fmt.Sprintf("test_%d", rand.Int63())
+  long := strings.Repeat("long", 100)
+  for i, name := range []string{"short", long} {
+    if err := db.Insert(table, "name", name, "id,tmp", i, i); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if _, err := db.GetCol(table, "tmp"); err != nil {
+    t.Fatal(err)
+  }
+
+  // drop column with its index
+  if err := db.DropColumn(table, "tmp"); err != nil {
+    t.Fatal(err)
+  }
+  if err := db.DropColumn(table, "tmp"); err != nil {
+    t.Fatal("drop again", err)
+  }
+  schema, _ := db.Table(table)
+  for _, column := range schema.Columns {
+    if column.Name == "tmp" {
+      t.Fatal("not dropped", schema.Columns)
+    }
+  }
+  if err := db.DropColumn(table, "serial"); err == nil {
+    t.Fatal("should not drop serial")
+  }
+
+  // rename long string column with its hash column and index
+  if err := db.RenameColumn(table, "name", "title"); err != nil {
+    t.Fatal(err)
+  }
+  info := db.tableInfo(table)
+  if _, ok := info.columns["name"]; ok || info.columnType["title"] != ColTypeLongString ||
+  info.columnType["hash_title"] != ColTypeHash || !info.index["hash_title"] || info.index["hash_name"] {
+    t.Fatal("renamed", info)
+  }
+  col, err := db.GetFilteredCol(table, "title, id", "title=" + long)
+  if err != nil || len(col) != 1 || col[0] != "1" {
+    t.Fatal("get by renamed index", col, err)
+  }
+  if err := db.RenameColumn(table, "name", "other"); err == nil {
+    t.Fatal("should fail on missing column")
+  }
+  if backend, ok := db.backend.(*tdhBackend); ok {
+    if definition, err := backend.mysql.showColumn(table, "title"); err != nil || !strings.HasPrefix(definition, "longtext ") {
+      t.Fatal("show column", definition, err)
+    }
+    if _, err := backend.mysql.showColumn(table, "name"); err == nil {
+      t.Fatal("show missing column")
+    }
+  }
+
+  // drop index by column names
+  if err := db.DropIndex(table, "title"); err != nil {
+    t.Fatal(err)
+  }
+  if db.tableInfo(table).index["hash_title"] {
+    t.Fatal("index not dropped")
+  }
+  if err := db.DropIndex(table, "title"); err != nil {
+    t.Fatal("drop again", err)
+  }
+
+  // drop table, recreated on insert
+  if err := db.DropTable(table); err != nil {
+    t.Fatal(err)
+  }
+  if _, ok := db.Table(table); ok {
+    t.Fatal("table not dropped")
+  }
+  if err := db.DropTable(table); err != nil {
+    t.Fatal("drop again", err)
+  }
+  if err := db.Insert(table, "name", "foo", "id", 1); err != nil {
+    t.Fatal(err)
+  }
+  if col, err := db.GetCol(table, "name"); err != nil || len(col) != 1 {
+    t.Fatal("recreated", col, err)
+  }
+}
+
+func TestMigrate(t *testing.T) {
+  h, err := NewWithConfig(Config{
+    Driver: DriverMemory,
+    Strict: true,
+    Schema: []TableDef{
+      {Name: "foo", Columns: []ColumnDef{{"a", ColTypeInt}}, Indexes: [][]string{{"a"}}},
+    },
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  runs := make(map[int]int)
+  migration := func(version int) Migration {
+    return Migration{
+      Version: version,
+      Name: fmt.Sprintf("insert %d", version),
+      Func: func(ctx context.Context, h *Handa) error {
+        runs[version]++
+        return h.InsertContext(ctx, "foo", "a", version, "")
+      },
+    }
+  }
+  if err := h.Migrate(migration(2), migration(1)); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.Migrate(migration(1), migration(2), migration(3)); err != nil {
+    t.Fatal(err)
+  }
+  if runs[1] != 1 || runs[2] != 1 || runs[3] != 1 {
+    t.Fatal("runs", runs)
+  }
+  applied, err := h.AppliedMigrations()
+  if err != nil || len(applied) != 3 || applied[0].Version != 1 || applied[2].Name != "insert 3" ||
+  time.Since(applied[2].AppliedAt) > time.Minute {
+    t.Fatal("applied", applied, err)
+  }
+
+  // failed ones are not recorded
+  fail := errors.New("fail")
+  err = h.Migrate(Migration{Version: 4, Func: func(context.Context, *Handa) error { return fail }}, migration(5))
+  if !errors.Is(err, fail) || runs[5] != 0 {
+    t.Fatal("should fail", err)
+  }
+  if applied, _ := h.AppliedMigrations(); len(applied) != 3 {
+    t.Fatal("recorded failed", applied)
+  }
+  if err := h.Migrate(Migration{Version: 4, SQL: []string{"SELECT 1"}}); err == nil {
+    t.Fatal("sql on memory backend")
+  }
+  if err := h.Migrate(migration(6), migration(6)); err == nil {
+    t.Fatal("duplicated version")
+  }
+
+  // sql
+  table := fmt.Sprintf("test_%d", rand.Int63())
+  if err := db.Insert(table, "a", 1, ""); err != nil {
+    t.Fatal(err)
+  }
+  err = db.Migrate(Migration{
+    Version: int(rand.Int31()) + 1,
+    SQL: []string{fmt.Sprintf("ALTER TABLE `%s` ADD `b` bigint NOT NULL DEFAULT '0'", table)},
+    Func: func(ctx context.Context, h *Handa) error {
+      _, _, err := h.UpdateContext(ctx, table, "a", 1, "b", 2)
+      return err
+    },
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  if m, err := db.GetMap(table, "a", "b"); err != nil || m["1"] != "2" {
+    t.Fatal("sql migration", m, err)
+  }
+
+  // recording a long name widens a column of MigrationsTable while migrating
+  config := testConfig
+  config.DDLLockTimeout = time.Second
+  h, err = NewWithConfig(config)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  if err := h.Migrate(Migration{Version: int(rand.Int31()) + 1, Name: strings.Repeat("n", 300)}); err != nil {
+    t.Fatal("long name", err)
+  }
+
+  // processes starting during a migration wait for it, up to MigrationLockTimeout.
+  // The lock is held on a connection pinged meanwhile.
+  lockKeepAliveInterval = time.Millisecond * 10
+  defer func() {
+    lockKeepAliveInterval = time.Minute
+  }()
+  started := make(chan struct{})
+  finish := make(chan struct{})
+  migrated := make(chan error, 1)
+  go func() {
+    migrated <- h.Migrate(Migration{Version: int(rand.Int31()) + 1, Func: func(context.Context, *Handa) error {
+      close(started)
+      <-finish
+      return nil
+    }})
+  }()
+  <-started
+  config.MigrationLockTimeout = time.Second
+  config.Migrations = []Migration{{Version: int(rand.Int31()) + 1}}
+  if _, err := NewWithConfig(config); !errors.Is(err, ErrDDLLockTimeout) {
+    t.Fatal("should time out", err)
+  }
+  config.MigrationLockTimeout = time.Minute
+  time.AfterFunc(time.Millisecond * 100, func() {
+    close(finish)
+  })
+  h2, err := NewWithConfig(config)
+  if err != nil {
+    t.Fatal("should wait", err)
+  }
+  defer h2.Close(context.Background())
+  if err := <-migrated; err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestCreateTable(t *testing.T) {
+  h, err := NewWithConfig(Config{
+    Driver: DriverMemory,
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  if err := h.Insert("foo", "a, b", []interface{}{1, strings.Repeat("b", 300)}, "c", "it's"); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.Insert("bar", "a", 1, ""); err != nil {
+    t.Fatal(err)
+  }
+  h2, err := NewWithConfig(Config{
+    Backend: h.backend,
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  tables, err := h2.LoadTables()
+  if err != nil || len(tables) != 2 || tables[0] != "bar" || tables[1] != "foo" {
+    t.Fatal("load tables", tables, err)
+  }
+  schema, _ := h2.Table("foo")
+  expected := "CREATE TABLE `foo` (\n" +
+    "  `serial` SERIAL,\n" +
+    "  `a` bigint(255) NULL DEFAULT '0',\n" +
+    "  `b` longtext NULL DEFAULT '',\n" +
+    "  `hash_b` char(32) NULL DEFAULT '',\n" +
+    "  `c` varchar(255) NULL DEFAULT '',\n" +
+    "  UNIQUE KEY `a$hash_b` (`a`,`hash_b`)\n" +
+    ") ENGINE=InnoDB"
+  if ddl := schema.CreateTable(); ddl != expected {
+    t.Fatal("ddl", ddl)
+  }
+  defaultValue := "it's\n"
+  schema.Columns[1].Default = &defaultValue
+  if ddl := schema.CreateTable(); !strings.Contains(ddl, `DEFAULT 'it\'s\n'`) {
+    t.Fatal("escape", ddl)
+  }
+  now := "CURRENT_TIMESTAMP(6)"
+  column := parseColumn("t", "datetime(6)", false, &now)
+  if definition := column.definition(stringEscaper.Replace); definition != "datetime(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)" {
+    t.Fatal("current timestamp", definition)
+  }
+
+  if ColTypeName(ColTypeLongString) != "ColTypeLongString" || ColTypeName(42) != "ColType(42)" {
+    t.Fatal("type name")
+  }
+}
+
+func TestIdentifiers(t *testing.T) {
+  backend := NewMemoryBackend()
+  h, err := NewWithConfig(Config{
+    Backend: backend,
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  var invalid *InvalidIdentifierError
+  for _, c := range []struct {
+    err error
+    kind string
+    reason string
+  }{
+    {h.Insert("foo bar", "a", 1, ""), "table", "only letters, digits and _ are allowed"},
+    {h.Insert("123", "a", 1, ""), "table", "all digits"},
+    {h.Insert("foo", "a`b", 1, ""), "column", "only letters, digits and _ are allowed"},
+    {h.Insert("foo", "a", 1, "b, c;d", 1, 2), "column", "only letters, digits and _ are allowed"},
+    {h.Insert("foo", "a", 1, strings.Repeat("c", 60), 1), "column", "longer than 59 bytes"},
+    {h.Insert("foo", strings.Repeat("a", 32) + "," + strings.Repeat("b", 32), []interface{}{1, 2}, ""), "index", "longer than 64 bytes"},
+    {func() error { _, err := h.GetCol("foo", "a$b"); return err }(), "column", "NUL, $ and , are not allowed"},
+    {func() error { _, err := h.GetFilteredCol("foo", "a", "a\x00=1"); return err }(), "column", "NUL, $ and , are not allowed"},
+    {func() error { _, err := h.GetFilteredCol("foo", "a", "=1"); return err }(), "column", "empty"},
+  } {
+    if !errors.Is(c.err, ErrInvalidIdentifier) || !errors.As(c.err, &invalid) || invalid.Kind != c.kind || invalid.Reason != c.reason {
+      t.Fatal(c.kind, c.reason, c.err)
+    }
+  }
+  if tables, _ := h.LoadTables(); len(tables) != 1 || tables[0] != "foo" {
+    t.Fatal("tables", tables)
+  }
+
+  // names are quoted, so reserved words are usable
+  if err := h.Insert("foo", "a", 2, "order", 42); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.RenameColumn("foo", "order", "key"); err != nil {
+    t.Fatal(err)
+  }
+  if m, err := h.GetMap("foo", "a", "key"); err != nil || m["2"] != "42" {
+    t.Fatal("reserved word column", m, err)
+  }
+  if err := h.Insert("select", "a", 1, ""); err != nil {
+    t.Fatal(err)
+  }
+
+  // existing names are only checked by the database
+  if _, err := h.GetCol("foo", "a)"); err == nil || errors.Is(err, ErrInvalidIdentifier) {
+    t.Fatal("missing column", err)
+  }
+  name := strings.Repeat("n", 64)
+  err = backend.(*memoryBackend).store.Do(func(tx *memstore.Tx) error {
+    if err := tx.CreateTable("my-table"); err != nil {
+      return err
+    }
+    if err := tx.AddColumn("my-table", "my col", "bigint(255)", "0"); err != nil {
+      return err
+    }
+    return tx.AddColumn("my-table", name, "varchar(255)", "")
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := h.Insert("my-table", "my col", 1, name, "foo"); err != nil {
+    t.Fatal(err)
+  }
+  if m, err := h.GetFilteredMap("my-table", "my col", name, "my col>0"); err != nil || m["1"] != "foo" {
+    t.Fatal("existing names", m, err)
+  }
+  if err := h.Insert("my-table", name, strings.Repeat("s", 300), ""); !errors.Is(err, ErrInvalidIdentifier) {
+    t.Fatal("hash column too long", err)
+  }
+
+  if quoted := quoteNames([]string{"a`b", "c"}); quoted != "`a``b`,`c`" {
+    t.Fatal("quote", quoted)
+  }
+}
+
+func TestHashCollision(t *testing.T) {
+  h, err := NewWithConfig(Config{
+    Driver: DriverMemory,
+    Hasher: HasherFunc(func(s string) string {
+      return "same"
+    }),
+    VerifyHashes: true,
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  table := "foo"
+  a := strings.Repeat("a", 300)
+  b := strings.Repeat("b", 300)
+  if err := h.Insert(table, "name", a, "v", 1); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.Insert(table, "name", a, "v", 1); !errors.Is(err, ErrDuplicateKey) {
+    t.Fatal("duplicated", err)
+  }
+  var collision *HashCollisionError
+  if err := h.Insert(table, "name", b, "v", 2); !errors.As(err, &collision) || !errors.Is(err, ErrHashCollision) ||
+  errors.Is(err, ErrDuplicateKey) || collision.Column != "name" || collision.Existing != a {
+    t.Fatal("insert", err)
+  }
+  if err := h.InsertUpdate(table, "name", b, "v", 3); !errors.Is(err, ErrHashCollision) {
+    t.Fatal("insert update", err)
+  }
+  if err := h.UpdateInsert(table, "name", b, "v", 4); !errors.Is(err, ErrHashCollision) {
+    t.Fatal("update insert", err)
+  }
+  if count, _, err := h.Update(table, "name", b, "v", 5); err != nil || count != 0 {
+    t.Fatal("update", count, err)
+  }
+  c := h.Batch()
+  c.Update(table, "name", a, "v", 1)
+  c.Insert(table, "name", b, "v", 6)
+  if _, err := c.Commit(); !errors.Is(err, ErrHashCollision) {
+    t.Fatal("batch", err)
+  }
+  if col, err := h.GetFilteredCol(table, "name, v", "name=" + a); err != nil || len(col) != 1 || col[0] != "1" {
+    t.Fatal("get", col, err)
+  }
+  if col, err := h.GetFilteredCol(table, "name, v", "name=" + b); err != nil || len(col) != 0 {
+    t.Fatal("mismatched", col, err)
+  }
+
+  // tdh
+  config := testConfig
+  config.Hasher = HasherFunc(func(s string) string {
+    return "same"
+  })
+  config.VerifyHashes = true
+  h, err = NewWithConfig(config)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  table = fmt.Sprintf("test_%d", rand.Int63())
+  if err := h.Insert(table, "name", a, "v", 1); err != nil {
+    t.Fatal(err)
+  }
+  if err := h.InsertUpdate(table, "name", b, "v", 2); !errors.Is(err, ErrHashCollision) {
+    t.Fatal("tdh insert update", err)
+  }
+  if count, _, err := h.Update(table, "name", b, "v", 3); err != nil || count != 0 {
+    t.Fatal("tdh update", count, err)
+  }
+  c = h.Batch()
+  c.Update(table, "name", a, "v", 1)
+  c.Insert(table, "name", b, "v", 4)
+  if _, err := c.Commit(); !errors.Is(err, ErrHashCollision) {
+    t.Fatal("tdh batch", err)
+  }
+  c = h.Batch()
+  c.Insert(table, "name", a, "v", 5)
+  if _, err := c.Commit(); !errors.Is(err, ErrDuplicateKey) || errors.Is(err, ErrHashCollision) {
+    t.Fatal("tdh batch duplicated", err)
+  }
+  if m, err := h.GetFilteredMap(table, "v", "name", "name=" + b); err != nil || len(m) != 0 {
+    t.Fatal("tdh mismatched", m, err)
+  }
+  if m, err := h.GetFilteredMap(table, "v", "name", "name=" + a); err != nil || m["1"] != a {
+    t.Fatal("tdh get", m, err)
+  }
+
+  // sql upserts do not update rows of colliding hashes
+  if *useMysql {
+    config.Driver = DriverSQL
+    config.VerifyHashes = false
+    h, err = NewWithConfig(config)
+    if err != nil {
+      t.Fatal(err)
+    }
+    defer h.Close(context.Background())
+    table = fmt.Sprintf("test_%d", rand.Int63())
+    if err := h.Insert(table, "name", a, "v", 1); err != nil {
+      t.Fatal(err)
+    }
+    if err := h.InsertUpdate(table, "name", b, "v", 2); !errors.Is(err, ErrHashCollision) {
+      t.Fatal("sql insert update", err)
+    }
+    if m, err := h.GetFilteredMap(table, "v", "name", "name=" + a); err != nil || m["1"] != a {
+      t.Fatal("sql get", m, err)
+    }
+  }
+
+  if SHA256Hasher.Hash("foo") != "2c26b46b68ffc68ff99b453c1d304134" || MMH3Hasher.Hash("foo") != mmh3Hex("foo") {
+    t.Fatal("hashers")
+  }
+  _, err = NewWithConfig(Config{
+    Driver: DriverMemory,
+    Hasher: HasherFunc(func(s string) string {
+      return strings.Repeat("h", 33)
+    }),
+  })
+  if err == nil {
+    t.Fatal("hashes longer than hash columns")
+  }
+}
+
+func TestCancelBatch(t *testing.T) {
+  config := testConfig
+  config.SocketConnPoolSize = 1
+  h, err := NewWithConfig(config)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  table := fmt.Sprintf("test_%d", rand.Int63())
+  if err := h.Insert(table, "id", 1, "v", "a"); err != nil {
+    t.Fatal(err)
+  }
+  ctx, cancel := context.WithCancel(context.Background())
+  c, err := h.BatchContext(ctx)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := c.Insert(table, "id", 2, "v", "b"); err != nil {
+    t.Fatal(err)
+  }
+  cancel()
+  if _, err := c.Commit(); err != context.Canceled {
+    t.Fatal("should be canceled", err)
+  }
+  if err := h.Insert(table, "id", 3, "v", "c"); err != nil {
+    t.Fatal(err)
+  }
+  if col, err := h.GetCol(table, "id"); err != nil || len(col) != 2 || col[0] != "1" || col[1] != "3" {
+    t.Fatal("get", col, err)
+  }
+}
+
+func TestMemstoreAtomic(t *testing.T) {
+  store := memstore.New()
+  err := store.Do(func(tx *memstore.Tx) error {
+    for _, name := range []string{"foo", "bar"} {
+      if err := tx.CreateTable(name); err != nil {
+        return err
+      }
+      if err := tx.AddColumn(name, "i", "bigint", "0"); err != nil {
+        return err
+      }
+      if err := tx.CreateIndex(name, "i", []string{"i"}, true); err != nil {
+        return err
+      }
+    }
+    for i := 0; i < 10; i++ {
+      if err := tx.Insert("foo", []string{"i"}, []string{strconv.Itoa(i)}); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // changes are undone, tables created and dropped included
+  err = store.Atomic(func(tx *memstore.Tx) error {
+    if err := tx.Insert("foo", []string{"i"}, []string{"10"}); err != nil {
+      return err
+    }
+    if _, _, err := tx.Update("foo", "i", []string{"i"}, [][]string{{"0"}}, tdh.EQ, 0, 0, nil, []string{"100"}); err != nil {
+      return err
+    }
+    if err := tx.DropTable("bar"); err != nil {
+      return err
+    }
+    if err := tx.CreateTable("baz"); err != nil {
+      return err
+    }
+    return tx.Insert("foo", []string{"i"}, []string{"5"})
+  })
+  if !errors.Is(err, memstore.ErrDuplicate) {
+    t.Fatal("should be duplicated", err)
+  }
+  err = store.Do(func(tx *memstore.Tx) error {
+    if tables := tx.Tables(); len(tables) != 2 || tables[0] != "bar" || tables[1] != "foo" {
+      t.Fatal("tables", tables)
+    }
+    rows, err := tx.Get("foo", "i", []string{"i"}, [][]string{{"0"}}, tdh.GE, 0, 0, nil)
+    if err != nil || len(rows) != 10 || rows[0][0] != "0" || rows[9][0] != "9" {
+      t.Fatal("get", rows, err)
+    }
+    // unique keys follow updates and deletes
+    if _, _, err := tx.Update("foo", "i", []string{"i"}, [][]string{{"0"}}, tdh.EQ, 0, 0, nil, []string{"100"}); err != nil {
+      t.Fatal(err)
+    }
+    if err := tx.Insert("foo", []string{"i"}, []string{"0"}); err != nil {
+      t.Fatal(err)
+    }
+    if _, err := tx.Delete("foo", "i", [][]string{{"5"}}, tdh.LE, 0, 3, nil); err != nil {
+      t.Fatal(err)
+    }
+    if err := tx.Insert("foo", []string{"i"}, []string{"100"}); !errors.Is(err, memstore.ErrDuplicate) {
+      t.Fatal("should be duplicated", err)
+    }
+    if err := tx.Insert("foo", []string{"i"}, []string{"4"}); err != nil {
+      t.Fatal(err)
+    }
+    rows, err = tx.Get("foo", "i", []string{"i"}, [][]string{{"4"}}, tdh.LT, 0, 0, nil)
+    if err != nil || len(rows) != 3 || rows[0][0] != "2" || rows[2][0] != "0" {
+      t.Fatal("get", rows, err)
+    }
+    rows, err = tx.Get("foo", "i", []string{"i"}, [][]string{{"4"}}, tdh.GT, 0, 2, nil)
+    if err != nil || len(rows) != 2 || rows[0][0] != "6" || rows[1][0] != "7" {
+      t.Fatal("get", rows, err)
+    }
+    return nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestTdhtestRoundTrip(t *testing.T) {
+  server, err := tdhtest.NewServer("test")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer server.Close()
+  err = server.Store.Do(func(tx *memstore.Tx) error {
+    if err := tx.CreateTable("foo"); err != nil {
+      return err
+    }
+    if err := tx.AddColumn("foo", "i", "bigint(20)", "0"); err != nil {
+      return err
+    }
+    if err := tx.AddColumn("foo", "s", "varchar(255)", ""); err != nil {
+      return err
+    }
+    return tx.CreateIndex("foo", "i", []string{"i"}, true)
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // requests are encoded by go-tdhsocket itself
+  conn, err := tdh.New("127.0.0.1:" + server.TdhPort, "", "")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer conn.Close()
+  for i := 0; i < 5; i++ {
+    if err := conn.Insert("test", "foo", "i", []string{"i", "s"}, []string{strconv.Itoa(i), "s" + strconv.Itoa(i)}); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if err := conn.Insert("test", "foo", "i", []string{"i"}, []string{"1"}); err == nil {
+    t.Fatal("should be duplicated")
+  }
+  rows, _, err := conn.Get("test", "foo", "i", []string{"i", "s"}, [][]string{{"1"}}, tdh.GE, 1, 2,
+    []tdh.Filter{{Field: "s", Op: tdh.FILTER_NOT, Value: "s3"}})
+  if err != nil || len(rows) != 2 || string(rows[0][0]) != "2" || string(rows[1][1]) != "s4" {
+    t.Fatal("get", rows, err)
+  }
+  count, change, err := conn.Update("test", "foo", "i", []string{"s"}, [][]string{{"3"}}, tdh.LE, 0, 0, nil, []string{"x"})
+  if err != nil || count != 4 || change != 4 {
+    t.Fatal("update", count, change, err)
+  }
+  change, err = conn.Delete("test", "foo", "i", nil, [][]string{{"0"}}, tdh.EQ, 0, 0, nil)
+  if err != nil || change != 1 {
+    t.Fatal("delete", change, err)
+  }
+
+  conn.Batch()
+  conn.Insert("test", "foo", "i", []string{"i", "s"}, []string{"10", "a"})
+  conn.Update("test", "foo", "i", []string{"s"}, [][]string{{"10"}}, tdh.EQ, 0, 0, nil, []string{"b"})
+  results, err := conn.Commit()
+  if err != nil || len(results) != 2 || results[0].Err != nil || results[1].Change != 1 {
+    t.Fatal("batch", results, err)
+  }
+  conn.Batch()
+  conn.Insert("test", "foo", "i", []string{"i"}, []string{"11"})
+  conn.Insert("test", "foo", "i", []string{"i"}, []string{"10"})
+  if _, err := conn.Commit(); err == nil {
+    t.Fatal("should be duplicated")
+  }
+  rows, _, err = conn.Get("test", "foo", "i", []string{"s"}, [][]string{{"10"}}, tdh.GE, 0, 0, nil)
+  if err != nil || len(rows) != 1 || string(rows[0][0]) != "b" {
+    t.Fatal("batch should be undone", rows, err)
+  }
+}
+
+func TestDDLOnTableDroppedElsewhere(t *testing.T) {
+  h1, err := NewWithConfig(testConfig)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h1.Close(context.Background())
+  h2, err := NewWithConfig(testConfig)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h2.Close(context.Background())
+  table := fmt.Sprintf("test_%d", rand.Int63())
+  if err := h1.Insert(table, "id", 1, "v", "a"); err != nil {
+    t.Fatal(err)
+  }
+  if err := h2.DropTable(table); err != nil {
+    t.Fatal(err)
+  }
+  // the stale schema of h1 is reloaded under the DDL lock, and found dropped
+  if err := h1.RenameColumn(table, "v", "w"); !errors.Is(err, ErrNoTable) {
+    t.Fatal("should be no table", err)
+  }
+  if err := h1.DropColumn(table, "v"); err != nil {
+    t.Fatal("dropped with the table", err)
+  }
+}
+
+func TestConcurrentDropTable(t *testing.T) {
+  h, err := NewWithConfig(Config{
+    Driver: DriverMemory,
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer h.Close(context.Background())
+  var wg sync.WaitGroup
+  errs := make(chan error, 1)
+  for i := 0; i < 4; i++ {
+    wg.Add(1)
+    go func(i int) {
+      defer wg.Done()
+      // operations racing the drop may fail, on a missing table or a column dropped with it, but must not panic
+      for j := 0; j < 200; j++ {
+        switch j % 3 {
+        case 0:
+          h.Insert("foo", "id", i * 1000 + j, "v," + fmt.Sprintf("c%d", j % 5), "a", strings.Repeat("b", 300))
+        case 1:
+          h.GetFilteredMap("foo", "id", "v", "v=a")
+        case 2:
+          h.Update("foo", "id", i * 1000 + j - 2, "v", "c")
+        }
+      }
+    }(i)
+  }
+  wg.Add(1)
+  go func() {
+    defer wg.Done()
+    for j := 0; j < 50; j++ {
+      if err := h.DropTable("foo"); err != nil {
+        errs <- err
+        return
+      }
+      time.Sleep(time.Millisecond)
+    }
+  }()
+  wg.Wait()
+  close(errs)
+  for err := range errs {
+    t.Fatal(err)
+  }
+}
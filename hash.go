@@ -0,0 +1,57 @@
+package handa
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "fmt"
+
+  tdh "github.com/reusee/go-tdhsocket"
+)
+
+// Hasher hashes long strings into hash columns. Hashes longer than 32 bytes do not fit in the CHAR(32) columns,
+// NewWithConfig fails on such a hasher.
+// Hashes already stored are not rebuilt, so the hasher of a database should not change.
+type Hasher interface {
+  Hash(s string) string
+}
+
+// HasherFunc adapts a function to Hasher, to plug in others like xxhash
+type HasherFunc func(s string) string
+
+func (self HasherFunc) Hash(s string) string {
+  return self(s)
+}
+
+var (
+  MMH3Hasher Hasher = HasherFunc(mmh3Hex) // 128 bit murmur3 in hex, the default
+  SHA256Hasher Hasher = HasherFunc(sha256Hex) // first 128 bits of SHA-256 in hex
+)
+
+// hashLength is the length of hash columns
+const hashLength = 32
+
+// checkHasher fails if hashes of hasher do not fit in hash columns
+func checkHasher(hasher Hasher) error {
+  if hash := hasher.Hash(""); len(hash) > hashLength {
+    return fmt.Errorf("hasher output %q longer than %d bytes", hash, hashLength)
+  }
+  return nil
+}
+
+func sha256Hex(s string) string {
+  sum := sha256.Sum256([]byte(s))
+  return hex.EncodeToString(sum[:16])
+}
+
+// hashFilters returns filters matching the texts of hashed key columns, nil if hashes are not verified
+func (self *Handa) hashFilters(dbIndexStrs []string, indexStrs []string, keyStrs []string) (filters []tdh.Filter) {
+  if !self.verifyHashes {
+    return nil
+  }
+  for i, column := range indexStrs {
+    if dbIndexStrs[i] != column { // hashed
+      filters = append(filters, tdh.Filter{Field: column, Op: tdh.FILTER_EQ, Value: keyStrs[i]})
+    }
+  }
+  return
+}
@@ -0,0 +1,75 @@
+package handa
+
+import (
+  "fmt"
+  "strings"
+)
+
+// MaxIdentifierLength is the max length in bytes of MySQL table, column and index names
+const MaxIdentifierLength = 64
+
+// validateIdentifier checks a table or column name given by callers, before it is used in any statement.
+// Names are quoted, so existing tables and columns may have any name but those handa can not pass along:
+// empty ones, and those with NUL or the $ and , separating names in indexes and field lists.
+func validateIdentifier(kind string, name string) error {
+  if name == "" {
+    return &InvalidIdentifierError{kind, name, "empty"}
+  }
+  if strings.ContainsAny(name, "\x00$,") {
+    return &InvalidIdentifierError{kind, name, "NUL, $ and , are not allowed"}
+  }
+  return nil
+}
+
+// validateNewIdentifier checks the name of a table or column to create, which is limited to what handa creates portably.
+// Column names are limited to leave room for the hash_ prefix of hash columns.
+func validateNewIdentifier(kind string, name string) error {
+  if err := validateIdentifier(kind, name); err != nil {
+    return err
+  }
+  maxLength := MaxIdentifierLength
+  if kind == "column" {
+    maxLength -= len("hash_")
+  }
+  if len(name) > maxLength {
+    return &InvalidIdentifierError{kind, name, fmt.Sprintf("longer than %d bytes", maxLength)}
+  }
+  allDigits := true
+  for i := 0; i < len(name); i++ {
+    c := name[i]
+    switch {
+    case c >= '0' && c <= '9':
+    case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+      allDigits = false
+    default:
+      return &InvalidIdentifierError{kind, name, "only letters, digits and _ are allowed"}
+    }
+  }
+  if allDigits {
+    return &InvalidIdentifierError{kind, name, "all digits"}
+  }
+  return nil
+}
+
+// validateIdentifiers checks names of the same kind
+func validateIdentifiers(kind string, names ...string) error {
+  for _, name := range names {
+    if err := validateIdentifier(kind, name); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// quoteName quotes a table, column or index name, doubling backticks in it
+func quoteName(name string) string {
+  return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func quoteNames(names []string) string {
+  quoted := make([]string, len(names))
+  for i, name := range names {
+    quoted[i] = quoteName(name)
+  }
+  return strings.Join(quoted, ",")
+}
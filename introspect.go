@@ -0,0 +1,159 @@
+package handa
+
+import (
+  "errors"
+  "fmt"
+  "sort"
+  "strings"
+)
+
+// TableSchema is a copy of the cached schema of a table
+type TableSchema struct {
+  Name string
+  Columns []ColumnSchema // in DESCRIBE order, hash columns are not listed
+  Indexes []IndexSchema // in name order
+}
+
+type ColumnSchema struct {
+  ColumnInfo
+  HashColumn string // column holding the hashes of this long string column, empty if none
+}
+
+type IndexSchema struct {
+  Name string // name in MySQL, columns joined by $, followed by NonUniqueSuffix if not unique
+  Columns []string // columns to pass as the index argument, long string columns instead of their hash columns
+  Unique bool
+}
+
+// Tables returns the names of loaded tables, sorted
+func (self *Handa) Tables() []string {
+  self.schemaMutex.RLock()
+  defer self.schemaMutex.RUnlock()
+  tables := make([]string, 0, len(self.schema))
+  for table := range self.schema {
+    tables = append(tables, table)
+  }
+  sort.Strings(tables)
+  return tables
+}
+
+// LoadTables loads all tables in the database, and returns their names sorted
+func (self *Handa) LoadTables() ([]string, error) {
+  tables, err := self.backend.Tables()
+  if err != nil {
+    return nil, err
+  }
+  var ret []string
+  for _, table := range tables {
+    tableInfo, err := self.loadTable(table)
+    if err != nil {
+      return nil, err
+    }
+    if tableInfo != nil { // not dropped meanwhile
+      ret = append(ret, table)
+    }
+  }
+  sort.Strings(ret)
+  return ret, nil
+}
+
+// Table returns the schema of table, loading it if not loaded. It returns false if the table does not exist.
+func (self *Handa) Table(name string) (TableSchema, bool) {
+  tableInfo, err := self.loadTable(name)
+  if err != nil || tableInfo == nil {
+    return TableSchema{}, false
+  }
+  return tableInfo.schema(), true
+}
+
+// Reload reloads the schemas of tables from the database. All loaded tables are reloaded if none is given.
+// Tables dropped outside handa are forgotten.
+func (self *Handa) Reload(tables ...string) error {
+  if len(tables) == 0 {
+    tables = self.Tables()
+  }
+  for _, table := range tables {
+    tableInfo, err := self.loadTableInfo(table)
+    if errors.Is(err, ErrNoTable) {
+      self.deleteTableInfo(table)
+      continue
+    }
+    if err != nil {
+      return err
+    }
+    self.setTableInfo(table, tableInfo)
+  }
+  return nil
+}
+
+func (self *TableInfo) schema() TableSchema {
+  ret := TableSchema{
+    Name: self.name,
+  }
+  for _, name := range self.columnNames {
+    if self.isHashColumn(name) {
+      continue
+    }
+    column := ColumnSchema{
+      ColumnInfo: *self.columns[name],
+    }
+    if column.Default != nil {
+      defaultValue := *column.Default
+      column.Default = &defaultValue
+    }
+    if _, ok := self.columns["hash_" + name]; ok && column.Type == ColTypeLongString {
+      column.HashColumn = "hash_" + name
+    }
+    ret.Columns = append(ret.Columns, column)
+  }
+  for index, unique := range self.index {
+    ret.Indexes = append(ret.Indexes, IndexSchema{
+      Name: index,
+      Columns: self.indexColumns(index),
+      Unique: unique,
+    })
+  }
+  sort.Slice(ret.Indexes, func(i, j int) bool {
+    return ret.Indexes[i].Name < ret.Indexes[j].Name
+  })
+  return ret
+}
+
+var stringEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\x00", `\0`, "\n", `\n`, "\r", `\r`, "\x1a", `\Z`)
+
+// CreateTable returns a CREATE TABLE statement reproducing the schema, as handa would have created it.
+// Each long string column is followed by its hash column, and indexes on serial are implied by SERIAL.
+func (self TableSchema) CreateTable() string {
+  var lines []string
+  hashColumns := make(map[string]string)
+  for _, column := range self.Columns {
+    if column.Name == "serial" {
+      lines = append(lines, "`serial` SERIAL")
+      continue
+    }
+    lines = append(lines, quoteName(column.Name) + " " + column.definition(stringEscaper.Replace))
+    if column.HashColumn != "" {
+      hashType, hashDefault := columnDefinition(ColTypeHash)
+      lines = append(lines, fmt.Sprintf("%s %s NULL DEFAULT %s", quoteName(column.HashColumn), strings.ToLower(hashType), hashDefault))
+      hashColumns[column.Name] = column.HashColumn
+    }
+  }
+  for _, index := range self.Indexes {
+    if len(index.Columns) == 1 && index.Columns[0] == "serial" {
+      continue
+    }
+    columns := make([]string, len(index.Columns))
+    for i, column := range index.Columns {
+      if hashColumn, ok := hashColumns[column]; ok {
+        column = hashColumn
+      }
+      columns[i] = column
+    }
+    kind := "KEY"
+    if index.Unique {
+      kind = "UNIQUE KEY"
+    }
+    lines = append(lines, fmt.Sprintf("%s %s (%s)", kind, quoteName(index.Name), quoteNames(columns)))
+  }
+  return fmt.Sprintf("CREATE TABLE %s (\n  %s\n) ENGINE=InnoDB", quoteName(self.Name), strings.Join(lines, ",\n  "))
+}
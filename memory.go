@@ -0,0 +1,305 @@
+package handa
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "strings"
+  "sync"
+
+  tdh "github.com/reusee/go-tdhsocket"
+  "github.com/reusee/handa/memstore"
+)
+
+// memoryBackend keeps everything in process memory, with the same schema-on-write behavior as MySQL.
+// Column types are stored as the MySQL types handa would create.
+type memoryBackend struct {
+  store *memstore.Store
+
+  closeMutex sync.RWMutex
+  closed bool
+}
+
+func NewMemoryBackend() Backend {
+  return &memoryBackend{
+    store: memstore.New(),
+  }
+}
+
+func (self *memoryBackend) Conn(ctx context.Context) (BackendConn, error) {
+  self.closeMutex.RLock()
+  defer self.closeMutex.RUnlock()
+  if self.closed {
+    return nil, ErrClosed
+  }
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+  return &memoryConn{backend: self}, nil
+}
+
+func (self *memoryBackend) Close() error {
+  self.closeMutex.Lock()
+  defer self.closeMutex.Unlock()
+  if self.closed {
+    return ErrClosed
+  }
+  self.closed = true
+  return nil
+}
+
+func (self *memoryBackend) Tables() (tables []string, err error) {
+  err = self.store.Do(func(tx *memstore.Tx) error {
+    tables = tx.Tables()
+    return nil
+  })
+  return
+}
+
+func (self *memoryBackend) SchemaVersions() (versions map[string]string, err error) {
+  versions = make(map[string]string)
+  err = self.store.Do(func(tx *memstore.Tx) error {
+    for _, table := range tx.Tables() {
+      columns, err := tx.Columns(table)
+      if err != nil {
+        return err
+      }
+      indexes, err := tx.Indexes(table)
+      if err != nil {
+        return err
+      }
+      versions[table] = fmt.Sprint(columns, indexes)
+    }
+    return nil
+  })
+  return
+}
+
+func (self *memoryBackend) LoadTable(table string) (*TableInfo, error) {
+  tableInfo := newTableInfo(table)
+  err := self.store.Do(func(tx *memstore.Tx) error {
+    columns, err := tx.Columns(table)
+    if err != nil {
+      return err
+    }
+    for _, column := range columns {
+      defaultValue := column.Default
+      tableInfo.addColumn(parseColumn(column.Name, column.Type, column.Name != "serial", &defaultValue))
+    }
+    indexes, err := tx.Indexes(table)
+    if err != nil {
+      return err
+    }
+    for _, index := range indexes {
+      tableInfo.index[index.Name] = index.Unique
+    }
+    return nil
+  })
+  if errors.Is(err, memstore.ErrNoTable) {
+    return tableInfo, fmt.Errorf("%w: %s", ErrNoTable, table)
+  }
+  if err != nil {
+    return tableInfo, fmt.Errorf("load table %s error: %v", table, err)
+  }
+  return tableInfo, nil
+}
+
+func (self *memoryBackend) CreateTable(table string) error {
+  return self.ddl(table, "CREATE TABLE " + table, func(tx *memstore.Tx) error {
+    err := tx.CreateTable(table)
+    if errors.Is(err, memstore.ErrTableExists) { // IF NOT EXISTS
+      return nil
+    }
+    return err
+  })
+}
+
+func (self *memoryBackend) AddColumn(table string, column string, t int) error {
+  columnType, defaultValue := columnDefinition(t)
+  return self.ddl(table, "ADD " + column + " " + columnType, func(tx *memstore.Tx) error {
+    return tx.AddColumn(table, column, columnType, memoryDefault(defaultValue))
+  })
+}
+
+func (self *memoryBackend) CreateIndex(table string, index string, columns []string, unique bool) error {
+  stmt := "CREATE INDEX " + index
+  if unique {
+    stmt = "CREATE UNIQUE INDEX " + index
+  }
+  return self.ddl(table, stmt, func(tx *memstore.Tx) error {
+    return tx.CreateIndex(table, index, columns, unique)
+  })
+}
+
+func (self *memoryBackend) ModifyColumn(table string, column string, t int) error {
+  columnType, defaultValue := columnDefinition(t)
+  return self.ddl(table, "MODIFY " + column + " " + columnType, func(tx *memstore.Tx) error {
+    return tx.ModifyColumn(table, column, columnType, memoryDefault(defaultValue))
+  })
+}
+
+func (self *memoryBackend) DropIndex(table string, index string) error {
+  return self.ddl(table, "DROP INDEX " + index, func(tx *memstore.Tx) error {
+    return tx.DropIndex(table, index)
+  })
+}
+
+func (self *memoryBackend) DropColumn(table string, column string) error {
+  return self.ddl(table, "DROP " + column, func(tx *memstore.Tx) error {
+    return tx.DropColumn(table, column)
+  })
+}
+
+func (self *memoryBackend) RenameColumn(table string, column string, newName string) error {
+  return self.ddl(table, "CHANGE " + column + " " + newName, func(tx *memstore.Tx) error {
+    return tx.RenameColumn(table, column, newName)
+  })
+}
+
+func (self *memoryBackend) DropTable(table string) error {
+  return self.ddl(table, "DROP TABLE " + table, func(tx *memstore.Tx) error {
+    return tx.DropTable(table)
+  })
+}
+
+// memoryDefault converts a default value of columnDefinition. NULL is stored as empty string, as tdh reads it.
+func memoryDefault(defaultValue string) string {
+  if defaultValue == "NULL" {
+    return ""
+  }
+  return strings.Trim(defaultValue, "'")
+}
+
+func (self *memoryBackend) ddl(table string, stmt string, fun func(tx *memstore.Tx) error) error {
+  if err := self.store.Do(fun); err != nil {
+    return &DDLError{table, stmt, err}
+  }
+  return nil
+}
+
+// wrapMemoryError marks duplicated entries with ErrDuplicateKey
+func wrapMemoryError(err error) error {
+  if errors.Is(err, memstore.ErrDuplicate) {
+    return &duplicateKeyError{err}
+  }
+  return err
+}
+
+type memoryConn struct {
+  backend *memoryBackend
+  isBatch bool
+  batch []func(tx *memstore.Tx) (Result, error)
+}
+
+func (self *memoryConn) Get(table string, index string, fields []string,
+key [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter) (rows [][][]byte, types []uint8, err error) {
+  err = self.backend.store.Do(func(tx *memstore.Tx) error {
+    res, err := tx.Get(table, index, fields, key, op, start, limit, filters)
+    if err != nil {
+      return err
+    }
+    rows = make([][][]byte, len(res))
+    for i, r := range res {
+      rows[i] = make([][]byte, len(r))
+      for j, col := range r {
+        rows[i][j] = []byte(col)
+      }
+    }
+    return nil
+  })
+  return
+}
+
+func (self *memoryConn) Insert(table string, index string, fields []string, values []string) error {
+  insert := func(tx *memstore.Tx) (Result, error) {
+    // index columns may appear twice in fields, the first one is kept
+    seen := make(map[string]bool)
+    var fs, vs []string
+    for i, field := range fields {
+      if !seen[field] {
+        seen[field] = true
+        fs = append(fs, field)
+        vs = append(vs, values[i])
+      }
+    }
+    if err := tx.Insert(table, fs, vs); err != nil {
+      return Result{INSERT, 0, 0, wrapMemoryError(err)}, wrapMemoryError(err)
+    }
+    return Result{INSERT, 1, 1, nil}, nil
+  }
+  if self.isBatch {
+    self.batch = append(self.batch, insert)
+    return nil
+  }
+  return self.backend.store.Do(func(tx *memstore.Tx) error {
+    _, err := insert(tx)
+    return err
+  })
+}
+
+func (self *memoryConn) Update(table string, index string, fields []string,
+key [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter, values []string) (count int, change int, err error) {
+  update := func(tx *memstore.Tx) (Result, error) {
+    count, change, err := tx.Update(table, index, fields, key, op, start, limit, filters, values)
+    return Result{UPDATE, change, count, wrapMemoryError(err)}, wrapMemoryError(err)
+  }
+  if self.isBatch {
+    self.batch = append(self.batch, update)
+    return
+  }
+  err = self.backend.store.Do(func(tx *memstore.Tx) error {
+    res, err := update(tx)
+    count, change = res.Count, res.Change
+    return err
+  })
+  return
+}
+
+func (self *memoryConn) Delete(table string, index string, fields []string,
+key [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter) (change int, err error) {
+  del := func(tx *memstore.Tx) (Result, error) {
+    change, err := tx.Delete(table, index, key, op, start, limit, filters)
+    return Result{DELETE, change, change, err}, err
+  }
+  if self.isBatch {
+    self.batch = append(self.batch, del)
+    return
+  }
+  err = self.backend.store.Do(func(tx *memstore.Tx) error {
+    res, err := del(tx)
+    change = res.Change
+    return err
+  })
+  return
+}
+
+func (self *memoryConn) Batch() {
+  self.isBatch = true
+}
+
+// Commit applies the queued operations atomically. If any operation fails, none is applied
+func (self *memoryConn) Commit() (ret []Result, err error) {
+  batch := self.batch
+  self.batch = nil
+  ret = make([]Result, len(batch))
+  err = self.backend.store.Atomic(func(tx *memstore.Tx) error {
+    for i, op := range batch {
+      var err error
+      ret[i], err = op(tx)
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  return ret, nil
+}
+
+func (self *memoryConn) Release() {
+}
@@ -0,0 +1,871 @@
+// Package memstore is an in-memory table store with the access semantics of
+// TDH_Socket: rows are found by an index, a key and an op, then filtered,
+// ordered by the index and cut by start and limit.
+// It backs handa's memory backend and the fake servers used in tests.
+package memstore
+
+import (
+  "errors"
+  "fmt"
+  "math/big"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+
+  tdh "github.com/reusee/go-tdhsocket"
+)
+
+var (
+  ErrTableExists = errors.New("table exists")
+  ErrNoTable = errors.New("no such table")
+  ErrColumnExists = errors.New("column exists")
+  ErrNoColumn = errors.New("no such column")
+  ErrIndexExists = errors.New("index exists")
+  ErrNoIndex = errors.New("no such index")
+  ErrDuplicate = errors.New("duplicate entry")
+  ErrUnknownOp = errors.New("unknown op")
+)
+
+const (
+  kindString = iota
+  kindInt
+  kindFloat
+  kindDecimal
+)
+
+type Column struct {
+  Name string
+  Type string // lower case MySQL type, as DESCRIBE shows
+  Default string
+  kind int
+  scale int // digits after the decimal point of decimal columns
+}
+
+type Index struct {
+  Name string
+  Columns []string
+  Unique bool
+}
+
+type Table struct {
+  Name string
+  columns []*Column
+  columnPos map[string]int
+  indexes []*Index
+  rows [][]string
+  serial uint64
+  unique map[string]map[string]int // unique index name -> key -> row position
+  orders map[string][]int // index name -> row positions in index order, dropped when rows change
+}
+
+type Store struct {
+  mutex sync.Mutex
+  tables map[string]*Table
+}
+
+func New() *Store {
+  return &Store{
+    tables: make(map[string]*Table),
+  }
+}
+
+// Tx gives access to the store while its lock is held
+type Tx struct {
+  store *Store
+  backup map[string]*Table // tables before the first change in Atomic, nil for tables created
+}
+
+// Do runs fun with the store locked
+func (self *Store) Do(fun func(tx *Tx) error) error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  return fun(&Tx{store: self})
+}
+
+// Atomic runs fun with the store locked, and undoes all changes if fun returns an error.
+// Tables are copied on their first change, so only the ones fun touches are cloned
+func (self *Store) Atomic(fun func(tx *Tx) error) error {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  tx := &Tx{
+    store: self,
+    backup: make(map[string]*Table),
+  }
+  if err := fun(tx); err != nil {
+    for name, table := range tx.backup {
+      if table == nil {
+        delete(self.tables, name)
+      } else {
+        self.tables[name] = table
+      }
+    }
+    return err
+  }
+  return nil
+}
+
+func (self *Table) clone() *Table {
+  table := &Table{
+    Name: self.Name,
+    columns: make([]*Column, len(self.columns)),
+    columnPos: make(map[string]int, len(self.columnPos)),
+    indexes: make([]*Index, len(self.indexes)),
+    rows: make([][]string, len(self.rows)),
+    serial: self.serial,
+  }
+  copy(table.columns, self.columns)
+  for name, pos := range self.columnPos {
+    table.columnPos[name] = pos
+  }
+  copy(table.indexes, self.indexes)
+  for i, row := range self.rows {
+    table.rows[i] = append([]string(nil), row...)
+  }
+  table.unique = make(map[string]map[string]int, len(self.unique))
+  for name, keys := range self.unique {
+    table.unique[name] = make(map[string]int, len(keys))
+    for key, pos := range keys {
+      table.unique[name][key] = pos
+    }
+  }
+  return table
+}
+
+// NormalizeType returns the type as MySQL's DESCRIBE shows it
+func NormalizeType(t string) string {
+  t = strings.ToLower(strings.TrimSpace(t))
+  switch t {
+  case "boolean", "bool":
+    return "tinyint(1)"
+  case "serial":
+    return "bigint(20) unsigned"
+  }
+  return t
+}
+
+var decimalPattern = regexp.MustCompile(`^decimal\((\d+)(?:,(\d+))?\)`)
+
+func newColumn(name string, t string, defaultValue string) *Column {
+  column := &Column{name, t, defaultValue, kindOf(t), 0}
+  if match := decimalPattern.FindStringSubmatch(t); match != nil && match[2] != "" {
+    column.scale, _ = strconv.Atoi(match[2])
+  }
+  column.Default = normalizeValue(column, defaultValue)
+  return column
+}
+
+func kindOf(t string) int {
+  for _, prefix := range []string{"tinyint", "smallint", "mediumint", "int", "bigint"} {
+    if strings.HasPrefix(t, prefix) {
+      return kindInt
+    }
+  }
+  if strings.HasPrefix(t, "decimal") {
+    return kindDecimal
+  }
+  for _, prefix := range []string{"double", "float", "real"} {
+    if strings.HasPrefix(t, prefix) {
+      return kindFloat
+    }
+  }
+  return kindString
+}
+
+// schema
+
+func (self *Tx) Tables() []string {
+  names := make([]string, 0, len(self.store.tables))
+  for name := range self.store.tables {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+func (self *Tx) table(name string) (*Table, error) {
+  table, ok := self.store.tables[name]
+  if !ok {
+    return nil, fmt.Errorf("%w: %s", ErrNoTable, name)
+  }
+  return table, nil
+}
+
+// writable returns the table for changing. In Atomic, the table is replaced by a clone on first change
+func (self *Tx) writable(name string) (*Table, error) {
+  table, err := self.table(name)
+  if err != nil {
+    return nil, err
+  }
+  if self.backup == nil {
+    return table, nil
+  }
+  if _, ok := self.backup[name]; !ok {
+    self.backup[name] = table
+    table = table.clone()
+    self.store.tables[name] = table
+  }
+  return table, nil
+}
+
+// remember records name as changed in Atomic, before it is created or dropped
+func (self *Tx) remember(name string) {
+  if self.backup == nil {
+    return
+  }
+  if _, ok := self.backup[name]; !ok {
+    self.backup[name] = self.store.tables[name]
+  }
+}
+
+// CreateTable creates a table with an auto increment serial column and its unique index
+func (self *Tx) CreateTable(name string) error {
+  if _, ok := self.store.tables[name]; ok {
+    return fmt.Errorf("%w: %s", ErrTableExists, name)
+  }
+  table := &Table{
+    Name: name,
+    columnPos: make(map[string]int),
+    unique: make(map[string]map[string]int),
+  }
+  table.addColumn("serial", "serial", "0")
+  table.indexes = append(table.indexes, &Index{"serial", []string{"serial"}, true})
+  table.unique["serial"] = make(map[string]int)
+  self.remember(name)
+  self.store.tables[name] = table
+  return nil
+}
+
+func (self *Tx) DropTable(name string) error {
+  if _, err := self.table(name); err != nil {
+    return err
+  }
+  self.remember(name)
+  delete(self.store.tables, name)
+  return nil
+}
+
+// Count returns the number of rows in the table
+func (self *Tx) Count(tableName string) (int, error) {
+  table, err := self.table(tableName)
+  if err != nil {
+    return 0, err
+  }
+  return len(table.rows), nil
+}
+
+func (self *Tx) Columns(tableName string) ([]Column, error) {
+  table, err := self.table(tableName)
+  if err != nil {
+    return nil, err
+  }
+  columns := make([]Column, len(table.columns))
+  for i, column := range table.columns {
+    columns[i] = *column
+  }
+  return columns, nil
+}
+
+func (self *Tx) Indexes(tableName string) ([]Index, error) {
+  table, err := self.table(tableName)
+  if err != nil {
+    return nil, err
+  }
+  indexes := make([]Index, len(table.indexes))
+  for i, index := range table.indexes {
+    indexes[i] = *index
+    indexes[i].Columns = append([]string(nil), index.Columns...)
+  }
+  return indexes, nil
+}
+
+func (self *Table) addColumn(name string, t string, defaultValue string) {
+  t = NormalizeType(t)
+  self.columnPos[name] = len(self.columns)
+  column := newColumn(name, t, defaultValue)
+  self.columns = append(self.columns, column)
+  for i, row := range self.rows {
+    self.rows[i] = append(row, column.Default)
+  }
+}
+
+func (self *Tx) AddColumn(tableName string, name string, t string, defaultValue string) error {
+  table, err := self.writable(tableName)
+  if err != nil {
+    return err
+  }
+  if _, ok := table.columnPos[name]; ok {
+    return fmt.Errorf("%w: %s", ErrColumnExists, name)
+  }
+  table.addColumn(name, t, defaultValue)
+  return nil
+}
+
+// ModifyColumn changes the type and default value of a column, converting existing values
+func (self *Tx) ModifyColumn(tableName string, name string, t string, defaultValue string) error {
+  table, err := self.writable(tableName)
+  if err != nil {
+    return err
+  }
+  pos, ok := table.columnPos[name]
+  if !ok {
+    return fmt.Errorf("%w: %s", ErrNoColumn, name)
+  }
+  t = NormalizeType(t)
+  column := newColumn(name, t, defaultValue)
+  rows := make([][]string, len(table.rows))
+  for i, row := range table.rows {
+    rows[i] = append([]string(nil), row...)
+    rows[i][pos] = normalizeValue(column, row[pos])
+  }
+  columns := append([]*Column(nil), table.columns...)
+  columns[pos] = column
+  unique, err := uniqueKeys(columns, table.indexes, rows)
+  if err != nil {
+    return err
+  }
+  table.columns = columns
+  table.rows = rows
+  table.unique = unique
+  table.orders = nil
+  return nil
+}
+
+// DropColumn removes the column from the table and its indexes, as MySQL does. Indexes left without columns are dropped.
+func (self *Tx) DropColumn(tableName string, name string) error {
+  table, err := self.writable(tableName)
+  if err != nil {
+    return err
+  }
+  pos, ok := table.columnPos[name]
+  if !ok {
+    return fmt.Errorf("%w: %s", ErrNoColumn, name)
+  }
+  var indexes []*Index
+  for _, index := range table.indexes {
+    var columns []string
+    for _, column := range index.Columns {
+      if column != name {
+        columns = append(columns, column)
+      }
+    }
+    if len(columns) > 0 {
+      indexes = append(indexes, &Index{index.Name, columns, index.Unique})
+    }
+  }
+  columns := append(table.columns[:pos:pos], table.columns[pos + 1:]...)
+  rows := make([][]string, len(table.rows))
+  for i, row := range table.rows {
+    rows[i] = append(row[:pos:pos], row[pos + 1:]...)
+  }
+  unique, err := uniqueKeys(columns, indexes, rows)
+  if err != nil {
+    return err
+  }
+  table.columns = columns
+  table.rows = rows
+  table.indexes = indexes
+  table.columnPos = make(map[string]int, len(columns))
+  for i, column := range columns {
+    table.columnPos[column.Name] = i
+  }
+  table.unique = unique
+  table.orders = nil
+  return nil
+}
+
+// RenameColumn renames the column in the table and its indexes
+func (self *Tx) RenameColumn(tableName string, name string, newName string) error {
+  table, err := self.writable(tableName)
+  if err != nil {
+    return err
+  }
+  pos, ok := table.columnPos[name]
+  if !ok {
+    return fmt.Errorf("%w: %s", ErrNoColumn, name)
+  }
+  if _, ok := table.columnPos[newName]; ok {
+    return fmt.Errorf("%w: %s", ErrColumnExists, newName)
+  }
+  column := *table.columns[pos]
+  column.Name = newName
+  table.columns[pos] = &column
+  delete(table.columnPos, name)
+  table.columnPos[newName] = pos
+  for i, index := range table.indexes {
+    columns := append([]string(nil), index.Columns...)
+    for j, c := range columns {
+      if c == name {
+        columns[j] = newName
+      }
+    }
+    table.indexes[i] = &Index{index.Name, columns, index.Unique}
+  }
+  table.orders = nil
+  return nil
+}
+
+func (self *Tx) DropIndex(tableName string, name string) error {
+  table, err := self.writable(tableName)
+  if err != nil {
+    return err
+  }
+  for i, index := range table.indexes {
+    if index.Name == name {
+      table.indexes = append(table.indexes[:i:i], table.indexes[i + 1:]...)
+      delete(table.unique, name)
+      delete(table.orders, name)
+      return nil
+    }
+  }
+  return fmt.Errorf("%w: %s", ErrNoIndex, name)
+}
+
+func (self *Tx) CreateIndex(tableName string, name string, columns []string, unique bool) error {
+  table, err := self.writable(tableName)
+  if err != nil {
+    return err
+  }
+  if table.index(name) != nil {
+    return fmt.Errorf("%w: %s", ErrIndexExists, name)
+  }
+  for _, column := range columns {
+    if _, ok := table.columnPos[column]; !ok {
+      return fmt.Errorf("%w: %s", ErrNoColumn, column)
+    }
+  }
+  index := &Index{name, append([]string(nil), columns...), unique}
+  if unique {
+    keys, err := uniqueKeys(table.columns, []*Index{index}, table.rows)
+    if err != nil {
+      return err
+    }
+    table.unique[name] = keys[name]
+  }
+  table.indexes = append(table.indexes, index)
+  return nil
+}
+
+func (self *Table) index(name string) *Index {
+  for _, index := range self.indexes {
+    if index.Name == name {
+      return index
+    }
+  }
+  return nil
+}
+
+// uniqueKey is the comparable form of the index columns of row
+func (self *Table) uniqueKey(index *Index, row []string) string {
+  return uniqueKey(self.columns, self.columnPos, index, row)
+}
+
+func uniqueKey(columns []*Column, columnPos map[string]int, index *Index, row []string) string {
+  parts := make([]string, len(index.Columns))
+  for i, column := range index.Columns {
+    pos := columnPos[column]
+    parts[i] = normalizeValue(columns[pos], row[pos])
+  }
+  return strings.Join(parts, "\x00")
+}
+
+// uniqueKeys maps the keys of rows to their positions for each unique index
+func uniqueKeys(columns []*Column, indexes []*Index, rows [][]string) (map[string]map[string]int, error) {
+  columnPos := make(map[string]int, len(columns))
+  for i, column := range columns {
+    columnPos[column.Name] = i
+  }
+  ret := make(map[string]map[string]int)
+  for _, index := range indexes {
+    if !index.Unique {
+      continue
+    }
+    keys := make(map[string]int, len(rows))
+    for i, row := range rows {
+      key := uniqueKey(columns, columnPos, index, row)
+      if _, ok := keys[key]; ok {
+        return nil, fmt.Errorf("%w for key %s", ErrDuplicate, index.Name)
+      }
+      keys[key] = i
+    }
+    ret[index.Name] = keys
+  }
+  return ret, nil
+}
+
+func normalizeValue(column *Column, v string) string {
+  switch column.kind {
+  case kindDecimal:
+    if r, ok := new(big.Rat).SetString(strings.TrimSpace(v)); ok {
+      return r.FloatString(column.scale)
+    }
+  case kindInt, kindFloat:
+    v := strings.TrimSpace(v)
+    if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+      return strconv.FormatInt(i, 10)
+    }
+    if u, err := strconv.ParseUint(v, 10, 64); err == nil {
+      return strconv.FormatUint(u, 10)
+    }
+    if f, err := strconv.ParseFloat(v, 64); err == nil {
+      return strconv.FormatFloat(f, 'g', -1, 64)
+    }
+  }
+  return v
+}
+
+// compare compares two values of a column
+func compare(kind int, a string, b string) int {
+  switch kind {
+  case kindDecimal:
+    ar, aOk := new(big.Rat).SetString(strings.TrimSpace(a))
+    br, bOk := new(big.Rat).SetString(strings.TrimSpace(b))
+    if aOk && bOk {
+      return ar.Cmp(br)
+    }
+  case kindInt, kindFloat:
+    a, b = strings.TrimSpace(a), strings.TrimSpace(b)
+    ai, aErr := strconv.ParseInt(a, 10, 64)
+    bi, bErr := strconv.ParseInt(b, 10, 64)
+    if aErr == nil && bErr == nil {
+      switch {
+      case ai < bi:
+        return -1
+      case ai > bi:
+        return 1
+      }
+      return 0
+    }
+    au, aErr := strconv.ParseUint(a, 10, 64)
+    bu, bErr := strconv.ParseUint(b, 10, 64)
+    if aErr == nil && bErr == nil {
+      switch {
+      case au < bu:
+        return -1
+      case au > bu:
+        return 1
+      }
+      return 0
+    }
+    af, aErr := strconv.ParseFloat(a, 64)
+    bf, bErr := strconv.ParseFloat(b, 64)
+    if aErr == nil && bErr == nil {
+      switch {
+      case af < bf:
+        return -1
+      case af > bf:
+        return 1
+      }
+      return 0
+    }
+  }
+  return strings.Compare(a, b)
+}
+
+// rows
+
+func (self *Table) checkUnique(row []string, skip int) error {
+  for _, index := range self.indexes {
+    if !index.Unique {
+      continue
+    }
+    key := self.uniqueKey(index, row)
+    if i, ok := self.unique[index.Name][key]; ok && i != skip {
+      return fmt.Errorf("%w '%s' for key '%s'", ErrDuplicate, strings.Replace(key, "\x00", "-", -1), index.Name)
+    }
+  }
+  return nil
+}
+
+// setRow puts row at pos, keeping the unique keys
+func (self *Table) setRow(pos int, row []string) {
+  for _, index := range self.indexes {
+    if !index.Unique {
+      continue
+    }
+    if pos < len(self.rows) {
+      delete(self.unique[index.Name], self.uniqueKey(index, self.rows[pos]))
+    }
+    self.unique[index.Name][self.uniqueKey(index, row)] = pos
+  }
+  if pos < len(self.rows) {
+    self.rows[pos] = row
+  } else {
+    self.rows = append(self.rows, row)
+  }
+  self.orders = nil
+}
+
+func (self *Tx) Insert(tableName string, fields []string, values []string) error {
+  table, err := self.writable(tableName)
+  if err != nil {
+    return err
+  }
+  row := make([]string, len(table.columns))
+  for i, column := range table.columns {
+    row[i] = column.Default
+  }
+  hasSerial := false
+  for i, field := range fields {
+    pos, ok := table.columnPos[field]
+    if !ok {
+      return fmt.Errorf("%w: %s", ErrNoColumn, field)
+    }
+    row[pos] = normalizeValue(table.columns[pos], values[i])
+    if field == "serial" {
+      hasSerial = true
+    }
+  }
+  serialPos := table.columnPos["serial"]
+  if !hasSerial {
+    row[serialPos] = strconv.FormatUint(table.serial + 1, 10)
+  }
+  if err := table.checkUnique(row, -1); err != nil {
+    return err
+  }
+  if serial, err := strconv.ParseUint(row[serialPos], 10, 64); err == nil && serial > table.serial {
+    table.serial = serial
+  }
+  table.setRow(len(table.rows), row)
+  return nil
+}
+
+// find returns positions of rows matched, in tdh order
+func (self *Table) find(indexName string, keys [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter) ([]int, error) {
+  index := self.index(indexName)
+  if index == nil {
+    return nil, fmt.Errorf("%w: %s", ErrNoIndex, indexName)
+  }
+  kinds := make([]int, len(index.Columns))
+  positions := make([]int, len(index.Columns))
+  for i, column := range index.Columns {
+    positions[i] = self.columnPos[column]
+    kinds[i] = self.columns[positions[i]].kind
+  }
+  type filterSpec struct {
+    pos int
+    kind int
+    op uint8
+    value string
+  }
+  specs := make([]filterSpec, len(filters))
+  for i, filter := range filters {
+    pos, ok := self.columnPos[filter.Field]
+    if !ok {
+      return nil, fmt.Errorf("%w: %s", ErrNoColumn, filter.Field)
+    }
+    specs[i] = filterSpec{pos, self.columns[pos].kind, filter.Op, filter.Value}
+  }
+
+  if op != tdh.EQ && op != tdh.GE && op != tdh.GT && op != tdh.LE && op != tdh.LT {
+    return nil, fmt.Errorf("%w: %d", ErrUnknownOp, op)
+  }
+  order := self.order(index, positions, kinds)
+  backward := op == tdh.LT || op == tdh.LE
+
+  var ret []int
+  skipped := uint32(0)
+  for _, key := range keys {
+    if len(key) > len(positions) {
+      return nil, fmt.Errorf("too many key parts for index %s", indexName)
+    }
+    cmp := func(i int) int {
+      row := self.rows[order[i]]
+      for j, part := range key {
+        if c := compare(kinds[j], row[positions[j]], part); c != 0 {
+          return c
+        }
+      }
+      return 0
+    }
+    // rows matched are a range of the order, forward from the first match or backward from the last
+    var i int
+    if backward {
+      i = sort.Search(len(order), func(i int) bool {
+        c := cmp(i)
+        return c > 0 || c == 0 && op == tdh.LT
+      }) - 1
+    } else {
+      i = sort.Search(len(order), func(i int) bool {
+        c := cmp(i)
+        return c > 0 || c == 0 && op != tdh.GT
+      })
+    }
+    step := 1
+    if backward {
+      step = -1
+    }
+    for ; i >= 0 && i < len(order); i += step {
+      if op == tdh.EQ && cmp(i) != 0 {
+        break
+      }
+      n := order[i]
+      row := self.rows[n]
+      match := true
+      for _, spec := range specs {
+        c := compare(spec.kind, row[spec.pos], spec.value)
+        switch spec.op {
+        case tdh.FILTER_EQ:
+          match = c == 0
+        case tdh.FILTER_GE:
+          match = c >= 0
+        case tdh.FILTER_GT:
+          match = c > 0
+        case tdh.FILTER_LE:
+          match = c <= 0
+        case tdh.FILTER_LT:
+          match = c < 0
+        case tdh.FILTER_NOT:
+          match = c != 0
+        default:
+          return nil, fmt.Errorf("%w: filter %d", ErrUnknownOp, spec.op)
+        }
+        if !match {
+          break
+        }
+      }
+      if !match {
+        continue
+      }
+      if skipped < start {
+        skipped++
+        continue
+      }
+      ret = append(ret, n)
+      if limit > 0 && uint32(len(ret)) >= limit {
+        return ret, nil
+      }
+    }
+  }
+  return ret, nil
+}
+
+// order returns row positions ordered by the index, then serial. It is kept until rows change
+func (self *Table) order(index *Index, positions []int, kinds []int) []int {
+  if order, ok := self.orders[index.Name]; ok {
+    return order
+  }
+  order := make([]int, len(self.rows))
+  for i := range order {
+    order[i] = i
+  }
+  serialPos := self.columnPos["serial"]
+  sort.Slice(order, func(i, j int) bool {
+    a, b := self.rows[order[i]], self.rows[order[j]]
+    for k, pos := range positions {
+      if c := compare(kinds[k], a[pos], b[pos]); c != 0 {
+        return c < 0
+      }
+    }
+    return compare(kindInt, a[serialPos], b[serialPos]) < 0
+  })
+  if self.orders == nil {
+    self.orders = make(map[string][]int)
+  }
+  self.orders[index.Name] = order
+  return order
+}
+
+func (self *Table) fieldPositions(fields []string) ([]int, error) {
+  positions := make([]int, len(fields))
+  for i, field := range fields {
+    pos, ok := self.columnPos[field]
+    if !ok {
+      return nil, fmt.Errorf("%w: %s", ErrNoColumn, field)
+    }
+    positions[i] = pos
+  }
+  return positions, nil
+}
+
+func (self *Tx) Get(tableName string, index string, fields []string,
+keys [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter) ([][]string, error) {
+  table, err := self.table(tableName)
+  if err != nil {
+    return nil, err
+  }
+  positions, err := table.fieldPositions(fields)
+  if err != nil {
+    return nil, err
+  }
+  found, err := table.find(index, keys, op, start, limit, filters)
+  if err != nil {
+    return nil, err
+  }
+  rows := make([][]string, len(found))
+  for i, n := range found {
+    rows[i] = make([]string, len(positions))
+    for j, pos := range positions {
+      rows[i][j] = table.rows[n][pos]
+    }
+  }
+  return rows, nil
+}
+
+func (self *Tx) Update(tableName string, index string, fields []string,
+keys [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter, values []string) (count int, change int, err error) {
+  table, err := self.writable(tableName)
+  if err != nil {
+    return 0, 0, err
+  }
+  positions, err := table.fieldPositions(fields)
+  if err != nil {
+    return 0, 0, err
+  }
+  found, err := table.find(index, keys, op, start, limit, filters)
+  if err != nil {
+    return 0, 0, err
+  }
+  for _, n := range found {
+    count++
+    row := append([]string(nil), table.rows[n]...)
+    changed := false
+    for i, pos := range positions {
+      value := normalizeValue(table.columns[pos], values[i])
+      if row[pos] != value {
+        row[pos] = value
+        changed = true
+      }
+    }
+    if !changed {
+      continue
+    }
+    if err := table.checkUnique(row, n); err != nil {
+      return count, change, err
+    }
+    table.setRow(n, row)
+    change++
+  }
+  return
+}
+
+func (self *Tx) Delete(tableName string, index string,
+keys [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter) (change int, err error) {
+  table, err := self.writable(tableName)
+  if err != nil {
+    return 0, err
+  }
+  found, err := table.find(index, keys, op, start, limit, filters)
+  if err != nil || len(found) == 0 {
+    return 0, err
+  }
+  remove := make(map[int]bool, len(found))
+  for _, n := range found {
+    remove[n] = true
+  }
+  rows := table.rows[:0:0]
+  for i, row := range table.rows {
+    if !remove[i] {
+      rows = append(rows, row)
+    }
+  }
+  table.rows = rows
+  table.unique, err = uniqueKeys(table.columns, table.indexes, rows)
+  table.orders = nil
+  return len(found), err
+}
@@ -0,0 +1,152 @@
+package handa
+
+import (
+  "context"
+  "fmt"
+  "sort"
+  "strconv"
+  "time"
+)
+
+// MigrationsTable records applied migrations. It is created when needed, even in strict mode.
+const MigrationsTable = "handa_migrations"
+
+// migrateLock is the DDLLocker key held while migrating. It is not a valid table name,
+// so DDL on MigrationsTable, like widening a column for a long Name, does not wait for it.
+const migrateLock = MigrationsTable + "$migrate"
+
+// Migration is a one-time change, like a backfill or an index swap. Migrations are applied in Version order, each at most once.
+type Migration struct {
+  Version int // positive and unique
+  Name string
+  SQL []string // statements run in order, MySQL backends only. DDL here skips TdhDDL handling, prefer Func with DropColumn and alike on the tdh driver.
+  Func func(ctx context.Context, h *Handa) error // run after SQL
+}
+
+// AppliedMigration is a row of MigrationsTable
+type AppliedMigration struct {
+  Version int
+  Name string
+  AppliedAt time.Time
+}
+
+var migrationsTableDef = TableDef{
+  Name: MigrationsTable,
+  Columns: []ColumnDef{
+    {"version", ColTypeInt},
+    {"name", ColTypeString},
+    {"applied_at", ColTypeTime},
+  },
+  Indexes: [][]string{{"version"}},
+}
+
+// Migrate applies migrations not recorded in MigrationsTable. Other processes migrating the same database wait up to MigrationLockTimeout, if the backend is a DDLLocker.
+// Loaded table schemas are reloaded afterwards, even if a migration failed.
+func (self *Handa) Migrate(migrations ...Migration) error {
+  return self.MigrateContext(context.Background(), migrations...)
+}
+
+func (self *Handa) MigrateContext(ctx context.Context, migrations ...Migration) (err error) {
+  migrations = append([]Migration(nil), migrations...)
+  sort.Slice(migrations, func(i, j int) bool {
+    return migrations[i].Version < migrations[j].Version
+  })
+  for i, migration := range migrations {
+    if migration.Version <= 0 {
+      return fmt.Errorf("migration %s: version %d not positive", migration.Name, migration.Version)
+    }
+    if i > 0 && migrations[i - 1].Version == migration.Version {
+      return fmt.Errorf("migration %s: version %d duplicated", migration.Name, migration.Version)
+    }
+  }
+
+  // the table is created before locking, so recording needs no DDL
+  if err := self.applySchema(ctx, []TableDef{migrationsTableDef}); err != nil {
+    return err
+  }
+  if locker, ok := self.backend.(DDLLocker); ok {
+    unlock, err := locker.LockDDL(migrateLock, self.migrationLockTimeout)
+    if err != nil {
+      return err
+    }
+    defer unlock()
+  }
+  defer func() {
+    if e := self.Reload(); err == nil {
+      err = e
+    }
+  }()
+
+  applied, err := self.AppliedMigrationsContext(ctx)
+  if err != nil {
+    return err
+  }
+  done := make(map[int]bool)
+  for _, migration := range applied {
+    done[migration.Version] = true
+  }
+  for _, migration := range migrations {
+    if done[migration.Version] {
+      continue
+    }
+    if err := ctx.Err(); err != nil {
+      return err
+    }
+    if err := self.runMigration(ctx, migration); err != nil {
+      return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+    }
+    if err := self.InsertContext(ctx, MigrationsTable, "version", migration.Version,
+      "name,applied_at", migration.Name, time.Now()); err != nil {
+      return fmt.Errorf("migration %d %s: applied but not recorded: %w", migration.Version, migration.Name, err)
+    }
+  }
+  return nil
+}
+
+func (self *Handa) runMigration(ctx context.Context, migration Migration) error {
+  for _, sql := range migration.SQL {
+    if _, _, err := self.mysqlQuery(sql); err != nil {
+      return err
+    }
+  }
+  if len(migration.SQL) > 0 { // tables changed by sql are not known
+    if err := self.Reload(); err != nil {
+      return err
+    }
+  }
+  if migration.Func != nil {
+    return migration.Func(ctx, self)
+  }
+  return nil
+}
+
+// AppliedMigrations returns the migrations recorded in MigrationsTable, in Version order
+func (self *Handa) AppliedMigrations() ([]AppliedMigration, error) {
+  return self.AppliedMigrationsContext(context.Background())
+}
+
+func (self *Handa) AppliedMigrationsContext(ctx context.Context) ([]AppliedMigration, error) {
+  tableInfo, err := self.loadTable(MigrationsTable)
+  if err != nil || tableInfo == nil {
+    return nil, err
+  }
+  rows, err := self.GetMultiMapContext(ctx, MigrationsTable, "version", "name,applied_at")
+  if err != nil {
+    return nil, err
+  }
+  var ret []AppliedMigration
+  for version, row := range rows {
+    migration := AppliedMigration{
+      Name: row[0],
+    }
+    if migration.Version, err = strconv.Atoi(version); err != nil {
+      return nil, fmt.Errorf("%s: bad version %q", MigrationsTable, version)
+    }
+    migration.AppliedAt, _ = ParseTime(row[1])
+    ret = append(ret, migration)
+  }
+  sort.Slice(ret, func(i, j int) bool {
+    return ret[i].Version < ret[j].Version
+  })
+  return ret, nil
+}
@@ -0,0 +1,303 @@
+package handa
+
+import (
+  "fmt"
+  "math"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/ziutek/mymysql/autorc"
+  "github.com/ziutek/mymysql/mysql"
+  _ "github.com/ziutek/mymysql/native"
+)
+
+// mysqlPool is the MySQL connection pool shared by MySQL based backends, with the schema statements they all use
+type mysqlPool struct {
+  config Config
+  conns chan *autorc.Conn
+
+  closeMutex sync.RWMutex
+  closed bool
+  quit chan struct{}
+}
+
+func newMysqlPool(config Config) (*mysqlPool, error) {
+  self := &mysqlPool{
+    config: config,
+    conns: make(chan *autorc.Conn, config.MysqlConnPoolSize),
+    quit: make(chan struct{}),
+  }
+  for i := 0; i < config.MysqlConnPoolSize; i++ {
+    conn := autorc.New("tcp", "", config.Host + ":" + config.Port, config.User, config.Password, config.Database)
+    conn.SetTimeout(config.DialTimeout)
+    conn.Register("set names " + config.Charset)
+    if err := conn.Raw.Connect(); err != nil {
+      self.close()
+      return nil, fmt.Errorf("mysql connect error: %v", err)
+    }
+    self.conns <- conn
+  }
+  return self, nil
+}
+
+func (self *mysqlPool) get() (*autorc.Conn, error) {
+  select {
+  case conn := <-self.conns:
+    return conn, nil
+  case <-self.quit:
+    return nil, ErrClosed
+  }
+}
+
+func (self *mysqlPool) put(conn *autorc.Conn) {
+  self.closeMutex.RLock()
+  defer self.closeMutex.RUnlock()
+  if self.closed {
+    conn.Raw.Close()
+    return
+  }
+  self.conns <- conn
+}
+
+func (self *mysqlPool) close() {
+  self.closeMutex.Lock()
+  defer self.closeMutex.Unlock()
+  if self.closed {
+    return
+  }
+  self.closed = true
+  close(self.quit)
+  for {
+    select {
+    case conn := <-self.conns:
+      conn.Raw.Close()
+    default:
+      return
+    }
+  }
+}
+
+func (self *mysqlPool) query(sql string, args ...interface{}) ([]mysql.Row, mysql.Result, error) {
+  conn, err := self.get()
+  if err != nil {
+    return nil, nil, err
+  }
+  defer self.put(conn)
+  return conn.Query(sql, args...)
+}
+
+func (self *mysqlPool) tables() ([]string, error) {
+  rows, _, err := self.query("SHOW TABLES")
+  if err != nil {
+    return nil, fmt.Errorf("show tables error: %v", err)
+  }
+  tables := make([]string, 0, len(rows))
+  for _, row := range rows {
+    tables = append(tables, row.Str(0))
+  }
+  return tables, nil
+}
+
+// lockKeepAliveInterval is how often connections holding named locks are pinged, so a lock held through a long migration is not lost to an idle timeout
+var lockKeepAliveInterval = time.Minute
+
+// lockDDL takes a MySQL named lock for DDL of table, on a connection of its own to not hold one of the pool.
+// The lock is released when the connection is closed, so the connection is not the auto reconnecting one.
+func (self *mysqlPool) lockDDL(table string, timeout time.Duration) (func(), error) {
+  conn := mysql.New("tcp", "", self.config.Host + ":" + self.config.Port, self.config.User, self.config.Password, self.config.Database)
+  conn.SetTimeout(self.config.DialTimeout)
+  if err := conn.Connect(); err != nil {
+    return nil, fmt.Errorf("mysql connect error: %v", err)
+  }
+  name := "handa." + self.config.Database + "." + table
+  if len(name) > 64 { // max length of lock names
+    name = "handa." + mmh3Hex(name)
+  }
+  name = conn.Escape(name)
+  rows, _, err := conn.Query("SELECT GET_LOCK('%s', %d)", name, int(math.Ceil(timeout.Seconds())))
+  if err != nil {
+    conn.Close()
+    return nil, fmt.Errorf("get lock error: %v", err)
+  }
+  if len(rows) == 0 || rows[0][0] == nil || rows[0].Int(0) != 1 {
+    conn.Close()
+    return nil, &DDLLockTimeoutError{table, timeout}
+  }
+  stop := make(chan struct{})
+  stopped := make(chan struct{})
+  go func() {
+    defer close(stopped)
+    ticker := time.NewTicker(lockKeepAliveInterval)
+    defer ticker.Stop()
+    for {
+      select {
+      case <-ticker.C:
+        conn.Ping()
+      case <-stop:
+        return
+      }
+    }
+  }()
+  return func() {
+    close(stop)
+    <-stopped // the connection is not safe for concurrent use
+    conn.Query("SELECT RELEASE_LOCK('%s')", name)
+    conn.Close()
+  }, nil
+}
+
+// schemaVersions sums up the columns and indexes of each table from information_schema
+func (self *mysqlPool) schemaVersions() (map[string]string, error) {
+  versions := make(map[string]string)
+  for _, query := range []string{
+    "SELECT TABLE_NAME, COUNT(*), SUM(CRC32(CONCAT(COLUMN_NAME, ' ', COLUMN_TYPE))) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() GROUP BY TABLE_NAME",
+    "SELECT TABLE_NAME, COUNT(*), SUM(CRC32(CONCAT(INDEX_NAME, ' ', COLUMN_NAME, ' ', NON_UNIQUE))) FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() GROUP BY TABLE_NAME",
+  } {
+    rows, _, err := self.query(query)
+    if err != nil {
+      return nil, fmt.Errorf("query information_schema error: %v", err)
+    }
+    for _, row := range rows {
+      versions[row.Str(0)] += row.Str(1) + ":" + row.Str(2) + " "
+    }
+  }
+  return versions, nil
+}
+
+func (self *mysqlPool) loadTable(tableName string) (*TableInfo, error) {
+  tableInfo := newTableInfo(tableName)
+  r, _, err := self.query("DESCRIBE %s", quoteName(tableName))
+  if e, ok := err.(*mysql.Error); ok && e.Code == mysql.ER_NO_SUCH_TABLE {
+    return tableInfo, fmt.Errorf("%w: %s", ErrNoTable, tableName)
+  }
+  if err != nil {
+    return tableInfo, fmt.Errorf("describe table %s error: %v", tableName, err)
+  }
+  for _, c := range r { // Field, Type, Null, Key, Default, Extra
+    var defaultValue *string
+    if c[4] != nil {
+      s := c.Str(4)
+      defaultValue = &s
+    }
+    tableInfo.addColumn(parseColumn(c.Str(0), c.Str(1), c.Str(2) == "YES", defaultValue))
+  }
+  r, _, err = self.query("SHOW INDEXES IN %s", quoteName(tableName))
+  if err != nil {
+    return tableInfo, fmt.Errorf("show indexes of %s error: %v", tableName, err)
+  }
+  for _, c := range r { // Table, Non_unique, Key_name, ...
+    tableInfo.index[c.Str(2)] = c.Int(1) == 0
+  }
+  return tableInfo, nil
+}
+
+// exec runs a DDL statement, wrapping the failure in a DDLError
+func (self *mysqlPool) exec(table string, stmt string) error {
+  if _, _, err := self.query(stmt); err != nil {
+    return &DDLError{table, stmt, err}
+  }
+  return nil
+}
+
+func (self *mysqlPool) createTable(table string) error {
+  return self.exec(table, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+          serial SERIAL
+        ) engine=InnoDB`, quoteName(table)))
+}
+
+func (self *mysqlPool) addColumn(table string, column string, t int) error {
+  columnType, defaultValue := columnDefinition(t)
+  return self.exec(table, fmt.Sprintf("ALTER TABLE %s ADD (%s %s NULL DEFAULT %s)",
+    quoteName(table), quoteName(column), columnType, defaultValue))
+}
+
+func (self *mysqlPool) modifyColumn(table string, column string, t int) error {
+  columnType, defaultValue := columnDefinition(t)
+  return self.exec(table, fmt.Sprintf("ALTER TABLE %s MODIFY %s %s NULL DEFAULT %s",
+    quoteName(table), quoteName(column), columnType, defaultValue))
+}
+
+func (self *mysqlPool) dropIndex(table string, index string) error {
+  return self.exec(table, fmt.Sprintf("DROP INDEX %s ON %s", quoteName(index), quoteName(table)))
+}
+
+func (self *mysqlPool) dropColumn(table string, column string) error {
+  return self.exec(table, fmt.Sprintf("ALTER TABLE %s DROP %s", quoteName(table), quoteName(column)))
+}
+
+// renameColumn uses CHANGE, as RENAME COLUMN is not in MySQL before 8.0.
+// The definition is taken from SHOW CREATE TABLE, which unlike DESCRIBE shows all of it.
+func (self *mysqlPool) renameColumn(table string, column string, newName string) error {
+  definition, err := self.showColumn(table, column)
+  if err != nil {
+    return err
+  }
+  return self.exec(table, fmt.Sprintf("ALTER TABLE %s CHANGE %s %s %s",
+    quoteName(table), quoteName(column), quoteName(newName), definition))
+}
+
+// showColumn returns the definition of column in SHOW CREATE TABLE, like "bigint(20) DEFAULT NULL COMMENT 'foo'"
+func (self *mysqlPool) showColumn(table string, column string) (string, error) {
+  stmt := "SHOW CREATE TABLE " + quoteName(table)
+  r, _, err := self.query(stmt)
+  if err != nil {
+    return "", &DDLError{table, stmt, err}
+  }
+  if len(r) > 0 {
+    prefix := quoteName(column) + " "
+    for _, line := range strings.Split(r[0].Str(1), "\n") { // one column per line
+      line = strings.TrimSpace(line)
+      if strings.HasPrefix(line, prefix) {
+        return strings.TrimSuffix(line[len(prefix):], ","), nil
+      }
+    }
+  }
+  return "", fmt.Errorf("table %s has no column %s", table, column)
+}
+
+func (self *mysqlPool) dropTable(table string) error {
+  return self.exec(table, fmt.Sprintf("DROP TABLE %s", quoteName(table)))
+}
+
+func (self *mysqlPool) createIndex(table string, index string, columns []string, unique bool) error {
+  kind := "INDEX"
+  if unique {
+    kind = "UNIQUE INDEX"
+  }
+  return self.exec(table, fmt.Sprintf("CREATE %s %s ON %s (%s)",
+    kind, quoteName(index), quoteName(table), quoteNames(columns)))
+}
+
+func columnDefinition(t int) (columnType string, defaultValue string) {
+  switch t {
+  case ColTypeBool:
+    columnType = "BOOLEAN"
+    defaultValue = "0"
+  case ColTypeInt:
+    columnType = "BIGINT(255)"
+    defaultValue = "0"
+  case ColTypeFloat:
+    columnType = "DOUBLE"
+    defaultValue = "0"
+  case ColTypeLongString:
+    columnType = "LONGTEXT"
+    defaultValue = "''"
+  case ColTypeString:
+    columnType = "VARCHAR(255)"
+    defaultValue = "''"
+  case ColTypeHash:
+    columnType = "CHAR(32)"
+    defaultValue = "''"
+  case ColTypeTime:
+    columnType = "DATETIME(6)"
+    defaultValue = "NULL"
+  case ColTypeDecimal:
+    columnType = "DECIMAL(65,30)"
+    defaultValue = "0"
+  case ColTypeUint:
+    columnType = "BIGINT(255) UNSIGNED"
+    defaultValue = "0"
+  }
+  return
+}
@@ -0,0 +1,61 @@
+package handa
+
+import (
+  "context"
+  "fmt"
+)
+
+// TableDef declares a table. Declared tables, columns and indexes are created when Handa starts.
+type TableDef struct {
+  Name string
+  Columns []ColumnDef
+  Indexes [][]string // columns of each unique index, long string columns are indexed by their hashes
+  NonUniqueIndexes [][]string // columns of each non-unique index, read with NonUniqueSuffix
+  Strict bool // reject writes that need a column or index not declared here
+}
+
+type ColumnDef struct {
+  Name string
+  Type int // ColType*
+}
+
+// applySchema creates everything declared in defs that is missing
+func (self *Handa) applySchema(ctx context.Context, defs []TableDef) error {
+  for _, def := range defs {
+    if err := self.ensureTableExists(ctx, def.Name); err != nil {
+      return err
+    }
+    for _, column := range def.Columns {
+      if columnType, _ := columnDefinition(column.Type); columnType == "" {
+        return fmt.Errorf("table %s column %s: unknown column type %d", def.Name, column.Name, column.Type)
+      }
+      if _, err := self.ensureColumnExists(ctx, def.Name, column.Name, column.Type, ""); err != nil {
+        return err
+      }
+    }
+    tableInfo, err := self.existingTable(def.Name)
+    if err != nil {
+      return err
+    }
+    indexes := append(append([][]string(nil), def.Indexes...), def.NonUniqueIndexes...)
+    for i, columns := range indexes {
+      for _, column := range columns {
+        if _, ok := tableInfo.columnType[column]; !ok && column != "serial" {
+          return fmt.Errorf("table %s index %v: column %s not declared", def.Name, columns, column)
+        }
+      }
+      if _, _, err := self.ensureIndexExists(ctx, def.Name, i < len(def.Indexes), columns...); err != nil {
+        return err
+      }
+    }
+    if def.Strict {
+      self.strictTables[def.Name] = true
+    }
+  }
+  return nil
+}
+
+// isStrict reports whether writes to table may not create tables, columns or indexes
+func (self *Handa) isStrict(table string) bool {
+  return table != MigrationsTable && (self.strict || self.strictTables[table])
+}
@@ -0,0 +1,445 @@
+package handa
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "regexp"
+  "strings"
+  "sync"
+  "time"
+
+  tdh "github.com/reusee/go-tdhsocket"
+  "github.com/ziutek/mymysql/autorc"
+  "github.com/ziutek/mymysql/mysql"
+)
+
+// sqlBackend serves everything through plain SQL over the MySQL pool, for servers without TDH_Socket.
+// A connection is taken from the pool per statement, so cursors never starve the DDL listeners.
+type sqlBackend struct {
+  mysql *mysqlPool
+
+  columnTypesMutex sync.RWMutex
+  columnTypes map[string]map[string]int // used to decide how to quote values
+}
+
+func NewSQLBackend(config Config) (Backend, error) {
+  config = config.withDefaults()
+  pool, err := newMysqlPool(config)
+  if err != nil {
+    return nil, err
+  }
+  return &sqlBackend{
+    mysql: pool,
+    columnTypes: make(map[string]map[string]int),
+  }, nil
+}
+
+func (self *sqlBackend) Conn(ctx context.Context) (BackendConn, error) {
+  select {
+  case <-self.mysql.quit:
+    return nil, ErrClosed
+  default:
+  }
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+  return &sqlConn{backend: self}, nil
+}
+
+func (self *sqlBackend) Close() error {
+  self.mysql.close()
+  return nil
+}
+
+func (self *sqlBackend) Query(sql string, args ...interface{}) ([]mysql.Row, mysql.Result, error) {
+  return self.mysql.query(sql, args...)
+}
+
+func (self *sqlBackend) Tables() ([]string, error) {
+  return self.mysql.tables()
+}
+
+func (self *sqlBackend) LockDDL(table string, timeout time.Duration) (func(), error) {
+  return self.mysql.lockDDL(table, timeout)
+}
+
+func (self *sqlBackend) SchemaVersions() (map[string]string, error) {
+  return self.mysql.schemaVersions()
+}
+
+func (self *sqlBackend) LoadTable(table string) (*TableInfo, error) {
+  tableInfo, err := self.mysql.loadTable(table)
+  if err != nil {
+    return tableInfo, err
+  }
+  self.columnTypesMutex.Lock()
+  self.columnTypes[table] = tableInfo.columnType
+  self.columnTypesMutex.Unlock()
+  return tableInfo, nil
+}
+
+func (self *sqlBackend) CreateTable(table string) error {
+  return self.mysql.createTable(table)
+}
+
+func (self *sqlBackend) AddColumn(table string, column string, t int) error {
+  return self.mysql.addColumn(table, column, t)
+}
+
+func (self *sqlBackend) CreateIndex(table string, index string, columns []string, unique bool) error {
+  return self.mysql.createIndex(table, index, columns, unique)
+}
+
+func (self *sqlBackend) ModifyColumn(table string, column string, t int) error {
+  return self.mysql.modifyColumn(table, column, t)
+}
+
+func (self *sqlBackend) DropColumn(table string, column string) error {
+  return self.mysql.dropColumn(table, column)
+}
+
+func (self *sqlBackend) RenameColumn(table string, column string, newName string) error {
+  return self.mysql.renameColumn(table, column, newName)
+}
+
+func (self *sqlBackend) DropTable(table string) error {
+  return self.mysql.dropTable(table)
+}
+
+func (self *sqlBackend) DropIndex(table string, index string) error {
+  return self.mysql.dropIndex(table, index)
+}
+
+var numberPattern = regexp.MustCompile(`^[-+]?[0-9]+(\.[0-9]*)?([eE][-+]?[0-9]+)?$`)
+
+// literal quotes value for column. Numbers for numeric columns are left bare,
+// so MySQL compares BIGINT keys exactly instead of as doubles.
+func (self *sqlBackend) literal(conn sqlQueryer, table string, column string, value string) string {
+  self.columnTypesMutex.RLock()
+  t, ok := self.columnTypes[table][column]
+  self.columnTypesMutex.RUnlock()
+  if ok && (t == ColTypeBool || t == ColTypeInt || t == ColTypeUint || t == ColTypeFloat || t == ColTypeDecimal) && numberPattern.MatchString(value) {
+    return value
+  }
+  return "'" + conn.Escape(value) + "'"
+}
+
+func (self *sqlBackend) with(fun func(conn *autorc.Conn) error) error {
+  conn, err := self.mysql.get()
+  if err != nil {
+    return err
+  }
+  defer self.mysql.put(conn)
+  return fun(conn)
+}
+
+// sqlQueryer is an autorc.Conn, or the mysql.Conn under it for statements which must not be retried
+type sqlQueryer interface {
+  Query(sql string, params ...interface{}) ([]mysql.Row, mysql.Result, error)
+  Escape(s string) string
+}
+
+type sqlConn struct {
+  backend *sqlBackend
+  isBatch bool
+  batch []func(conn sqlQueryer) (Result, error)
+}
+
+func indexColumns(index string) []string {
+  if index == "serial" || index == "PRIMARY" {
+    return []string{"serial"}
+  }
+  columns, _ := splitIndex(index)
+  return columns
+}
+
+var sqlOps = map[uint8]string{
+  tdh.EQ: "=",
+  tdh.GE: ">=",
+  tdh.LE: "<=",
+  tdh.GT: ">",
+  tdh.LT: "<",
+}
+
+var sqlFilterOps = map[uint8]string{
+  tdh.FILTER_EQ: "=",
+  tdh.FILTER_GE: ">=",
+  tdh.FILTER_LE: "<=",
+  tdh.FILTER_GT: ">",
+  tdh.FILTER_LT: "<",
+  tdh.FILTER_NOT: "!=",
+}
+
+// where builds the WHERE and ORDER BY clauses of a tdh style request
+func (self *sqlConn) where(conn sqlQueryer, table string, index string,
+keys [][]string, op uint8, filters []tdh.Filter) (where string, orderBy string, err error) {
+  columns := indexColumns(index)
+  opStr, ok := sqlOps[op]
+  if !ok {
+    return "", "", fmt.Errorf("unknown op %d", op)
+  }
+  var conds []string
+  var keyConds []string
+  for _, key := range keys {
+    if len(key) == 0 {
+      continue
+    }
+    if len(key) > len(columns) {
+      return "", "", fmt.Errorf("too many key parts for index %s", index)
+    }
+    literals := make([]string, len(key))
+    for i, part := range key {
+      literals[i] = self.backend.literal(conn, table, columns[i], part)
+    }
+    if op == tdh.EQ {
+      parts := make([]string, len(key))
+      for i := range key {
+        parts[i] = quoteName(columns[i]) + " = " + literals[i]
+      }
+      keyConds = append(keyConds, "(" + strings.Join(parts, " AND ") + ")")
+    } else {
+      keyConds = append(keyConds, "((" + quoteNames(columns[:len(key)]) + ") " + opStr +
+        " (" + strings.Join(literals, ",") + "))")
+    }
+  }
+  if len(keyConds) > 0 {
+    conds = append(conds, "(" + strings.Join(keyConds, " OR ") + ")")
+  }
+  for _, filter := range filters {
+    filterOp, ok := sqlFilterOps[filter.Op]
+    if !ok {
+      return "", "", fmt.Errorf("unknown filter op %d", filter.Op)
+    }
+    conds = append(conds, quoteName(filter.Field) + " " + filterOp + " " +
+      self.backend.literal(conn, table, filter.Field, filter.Value))
+  }
+  if len(conds) > 0 {
+    where = " WHERE " + strings.Join(conds, " AND ")
+  }
+  direction := ""
+  if op == tdh.LT || op == tdh.LE { // tdh scans backward for these
+    direction = " DESC"
+  }
+  orders := make([]string, len(columns))
+  for i, column := range columns {
+    orders[i] = quoteName(column) + direction
+  }
+  orderBy = " ORDER BY " + strings.Join(orders, ",")
+  return
+}
+
+func limitClause(start uint32, limit uint32) string {
+  if start == 0 && limit == 0 {
+    return ""
+  }
+  if limit == 0 {
+    return fmt.Sprintf(" LIMIT %d, 18446744073709551615", start)
+  }
+  return fmt.Sprintf(" LIMIT %d, %d", start, limit)
+}
+
+var rowsMatchedPattern = regexp.MustCompile(`Rows matched: (\d+)`)
+
+// wrapMysqlError marks MySQL duplicate entry errors with ErrDuplicateKey
+func wrapMysqlError(err error) error {
+  if e, ok := err.(*mysql.Error); ok && e.Code == mysql.ER_DUP_ENTRY {
+    return &duplicateKeyError{err}
+  }
+  return err
+}
+
+func (self *sqlConn) Get(table string, index string, fields []string,
+key [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter) (rows [][][]byte, types []uint8, err error) {
+  err = self.backend.with(func(conn *autorc.Conn) error {
+    where, orderBy, err := self.where(conn, table, index, key, op, filters)
+    if err != nil {
+      return err
+    }
+    res, _, err := conn.Query("SELECT " + quoteNames(fields) + " FROM " + quoteName(table) +
+      where + orderBy + limitClause(start, limit))
+    if err != nil {
+      return err
+    }
+    rows = make([][][]byte, len(res))
+    for i, r := range res {
+      rows[i] = make([][]byte, len(r))
+      for j := range r {
+        if r[j] != nil {
+          rows[i][j] = r[j].([]byte)
+        }
+      }
+    }
+    return nil
+  })
+  return
+}
+
+func (self *sqlConn) Insert(table string, index string, fields []string, values []string) error {
+  insert := func(conn sqlQueryer) (Result, error) {
+    _, res, err := conn.Query(self.insertStmt(conn, table, fields, values))
+    if err != nil {
+      return Result{INSERT, 0, 0, wrapMysqlError(err)}, wrapMysqlError(err)
+    }
+    return Result{INSERT, int(res.AffectedRows()), int(res.AffectedRows()), nil}, nil
+  }
+  if self.isBatch {
+    self.batch = append(self.batch, insert)
+    return nil
+  }
+  return self.backend.with(func(conn *autorc.Conn) error {
+    _, err := insert(conn)
+    return err
+  })
+}
+
+// insertStmt builds an INSERT. Index columns may appear twice in fields, the first one is kept
+func (self *sqlConn) insertStmt(conn sqlQueryer, table string, fields []string, values []string) string {
+  seen := make(map[string]bool)
+  var names, literals []string
+  for i, field := range fields {
+    if seen[field] {
+      continue
+    }
+    seen[field] = true
+    names = append(names, field)
+    literals = append(literals, self.backend.literal(conn, table, field, values[i]))
+  }
+  return "INSERT INTO " + quoteName(table) + " (" + quoteNames(names) + ") VALUES (" +
+    strings.Join(literals, ",") + ")"
+}
+
+func (self *sqlConn) Update(table string, index string, fields []string,
+key [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter, values []string) (count int, change int, err error) {
+  if start > 0 {
+    return 0, 0, errors.New("update with start is not supported by sql backend")
+  }
+  update := func(conn sqlQueryer) (Result, error) {
+    where, orderBy, err := self.where(conn, table, index, key, op, filters)
+    if err != nil {
+      return Result{UPDATE, 0, 0, err}, err
+    }
+    sets := make([]string, len(fields))
+    for i, field := range fields {
+      sets[i] = quoteName(field) + " = " + self.backend.literal(conn, table, field, values[i])
+    }
+    if len(sets) == 0 { // still report matched rows
+      sets = []string{"`serial` = `serial`"}
+    }
+    _, res, err := conn.Query("UPDATE " + quoteName(table) + " SET " + strings.Join(sets, ",") +
+      where + orderBy + limitClause(0, limit))
+    if err != nil {
+      return Result{UPDATE, 0, 0, wrapMysqlError(err)}, wrapMysqlError(err)
+    }
+    change := int(res.AffectedRows())
+    count := change
+    if matches := rowsMatchedPattern.FindStringSubmatch(res.Message()); matches != nil {
+      fmt.Sscan(matches[1], &count)
+    }
+    return Result{UPDATE, change, count, nil}, nil
+  }
+  if self.isBatch {
+    self.batch = append(self.batch, update)
+    return
+  }
+  err = self.backend.with(func(conn *autorc.Conn) error {
+    res, err := update(conn)
+    count, change = res.Count, res.Change
+    return err
+  })
+  return
+}
+
+func (self *sqlConn) Delete(table string, index string, fields []string,
+key [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter) (change int, err error) {
+  if start > 0 {
+    return 0, errors.New("delete with start is not supported by sql backend")
+  }
+  del := func(conn sqlQueryer) (Result, error) {
+    where, orderBy, err := self.where(conn, table, index, key, op, filters)
+    if err != nil {
+      return Result{DELETE, 0, 0, err}, err
+    }
+    _, res, err := conn.Query("DELETE FROM " + quoteName(table) + where + orderBy + limitClause(0, limit))
+    if err != nil {
+      return Result{DELETE, 0, 0, err}, err
+    }
+    return Result{DELETE, int(res.AffectedRows()), int(res.AffectedRows()), nil}, nil
+  }
+  if self.isBatch {
+    self.batch = append(self.batch, del)
+    return
+  }
+  err = self.backend.with(func(conn *autorc.Conn) error {
+    res, err := del(conn)
+    change = res.Change
+    return err
+  })
+  return
+}
+
+// Upsert inserts a row, or updates updateFields of the row having the same unique key, in one statement
+func (self *sqlConn) Upsert(table string, index string, fields []string, values []string, updateFields []string) error {
+  return self.backend.with(func(conn *autorc.Conn) error {
+    sets := make([]string, len(updateFields))
+    for i, field := range updateFields {
+      sets[i] = quoteName(field) + " = VALUES(" + quoteName(field) + ")"
+    }
+    if len(sets) == 0 {
+      sets = []string{"`serial` = `serial`"}
+    }
+    _, _, err := conn.Query(self.insertStmt(conn, table, fields, values) +
+      " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ","))
+    return wrapMysqlError(err)
+  })
+}
+
+func (self *sqlConn) Batch() {
+  self.isBatch = true
+}
+
+// Commit runs the queued statements in one transaction. If any statement fails, the whole batch is rolled back.
+// The batch runs on the raw connection, since autorc would reconnect and replay a statement outside the transaction
+func (self *sqlConn) Commit() (ret []Result, err error) {
+  batch := self.batch
+  self.batch = nil
+  err = self.backend.with(func(conn *autorc.Conn) error {
+    raw := conn.Raw
+    if !raw.IsConnected() {
+      if err := raw.Connect(); err != nil {
+        return err
+      }
+    }
+    if _, _, err := raw.Query("START TRANSACTION"); err != nil {
+      raw.Close()
+      return err
+    }
+    ret = make([]Result, len(batch))
+    for i, stmt := range batch {
+      var err error
+      ret[i], err = stmt(raw)
+      if err != nil {
+        if _, _, e := raw.Query("ROLLBACK"); e != nil {
+          // the transaction may still be open, autorc reconnects on next use
+          raw.Close()
+        }
+        return err
+      }
+    }
+    if _, _, err := raw.Query("COMMIT"); err != nil {
+      raw.Close()
+      return err
+    }
+    return nil
+  })
+  if err != nil {
+    return nil, err
+  }
+  return ret, nil
+}
+
+func (self *sqlConn) Release() {
+}
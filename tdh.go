@@ -0,0 +1,352 @@
+package handa
+
+import (
+  "context"
+  "fmt"
+  "sync"
+  "time"
+
+  tdh "github.com/reusee/go-tdhsocket"
+  "github.com/ziutek/mymysql/mysql"
+)
+
+// DDL modes of the tdh backend, chosen by Config.TdhDDL.
+// TDH_Socket keeps tables open between requests, and an open table keeps its old definition, so DDL has to make TDH_Socket reopen it.
+const (
+  // TdhDDLToggle sets the global tdh_socket_cache_table_on to 0 while running DDL, which needs the SUPER privilege
+  // and turns off table caching for every client of the server meanwhile. No request sent after the DDL returns uses the old definition.
+  TdhDDLToggle = "toggle"
+  // TdhDDLFlush runs FLUSH TABLES on the table after DDL, which needs the RELOAD privilege only and leaves table caching on.
+  // TDH_Socket reopens the table when it is used next, but requests running during the DDL may still use the old definition,
+  // and DDL may wait for them to finish.
+  TdhDDLFlush = "flush"
+  // TdhDDLForbidden fails all DDL with ErrDDLForbidden. Tables, columns and indexes must exist before they are used,
+  // and the schema never changes under running requests.
+  TdhDDLForbidden = "forbidden"
+)
+
+// tdhBackend reads and writes rows through TDH_Socket, and runs DDL through the MySQL pool
+type tdhBackend struct {
+  mysql *mysqlPool
+  dbname string
+  socketConnPool chan *tdh.Conn
+  dial func() (*tdh.Conn, error)
+
+  runDDL func(table string, fun func() error) error // by DDL mode
+  tableCacheVarMutex *sync.Mutex
+  tableCacheVarCount int
+
+  closeMutex sync.RWMutex
+  closed bool
+  quit chan struct{}
+}
+
+func NewTdhBackend(config Config) (Backend, error) {
+  config = config.withDefaults()
+  self := &tdhBackend{
+    dbname: config.Database,
+    socketConnPool: make(chan *tdh.Conn, config.SocketConnPoolSize),
+    tableCacheVarMutex: new(sync.Mutex),
+    quit: make(chan struct{}),
+  }
+  switch config.TdhDDL {
+  case TdhDDLToggle, "":
+    self.runDDL = self.withTableCacheOff
+  case TdhDDLFlush:
+    self.runDDL = self.withTableFlushed
+  case TdhDDLForbidden:
+    self.runDDL = forbidDDL
+  default:
+    return nil, fmt.Errorf("unknown tdh ddl mode %s", config.TdhDDL)
+  }
+  var err error
+  self.mysql, err = newMysqlPool(config)
+  if err != nil {
+    return nil, err
+  }
+  self.dial = func() (*tdh.Conn, error) {
+    return dialTdh(config.Host + ":" + config.TdhPort,
+      config.TdhReadPassword, config.TdhWritePassword, config.DialTimeout)
+  }
+  for i := 0; i < config.SocketConnPoolSize; i++ {
+    socket, err := self.dial()
+    if err != nil {
+      self.Close()
+      return nil, fmt.Errorf("tdhsocket connect error: %v", err)
+    }
+    self.socketConnPool <- socket
+  }
+  return self, nil
+}
+
+// dialTdh is tdh.New with a timeout. tdh.New has no dial timeout of its own,
+// so a late connection is closed when it finally arrives.
+func dialTdh(addr string, readCode string, writeCode string, timeout time.Duration) (*tdh.Conn, error) {
+  if timeout <= 0 {
+    return tdh.New(addr, readCode, writeCode)
+  }
+  type dialResult struct {
+    conn *tdh.Conn
+    err error
+  }
+  done := make(chan dialResult, 1)
+  go func() {
+    conn, err := tdh.New(addr, readCode, writeCode)
+    done <- dialResult{conn, err}
+  }()
+  select {
+  case res := <-done:
+    return res.conn, res.err
+  case <-time.After(timeout):
+    go func() {
+      if res := <-done; res.err == nil {
+        res.conn.Close()
+      }
+    }()
+    return nil, fmt.Errorf("dial %s timeout", addr)
+  }
+}
+
+func (self *tdhBackend) Conn(ctx context.Context) (BackendConn, error) {
+  select {
+  case conn := <-self.socketConnPool:
+    return &tdhConn{backend: self, conn: conn}, nil
+  case <-ctx.Done():
+    return nil, ctx.Err()
+  case <-self.quit:
+    return nil, ErrClosed
+  }
+}
+
+func (self *tdhBackend) releaseSocket(conn *tdh.Conn) {
+  self.closeMutex.RLock()
+  defer self.closeMutex.RUnlock()
+  if self.closed {
+    conn.Close()
+    return
+  }
+  self.socketConnPool <- conn
+}
+
+// replaceSocket closes a socket in an unknown state, like one with uncommitted batch requests,
+// and puts a new one into the pool, redialing until the backend is closed
+func (self *tdhBackend) replaceSocket(conn *tdh.Conn) {
+  conn.Close()
+  go func() {
+    for {
+      socket, err := self.dial()
+      if err == nil {
+        self.releaseSocket(socket)
+        return
+      }
+      select {
+      case <-self.quit:
+        return
+      case <-time.After(time.Second):
+      }
+    }
+  }()
+}
+
+func (self *tdhBackend) Close() error {
+  self.closeMutex.Lock()
+  defer self.closeMutex.Unlock()
+  if self.closed {
+    return ErrClosed
+  }
+  self.closed = true
+  close(self.quit)
+  if self.mysql != nil {
+    self.mysql.close()
+  }
+  for {
+    select {
+    case socket := <-self.socketConnPool:
+      socket.Close()
+    default:
+      return nil
+    }
+  }
+}
+
+func (self *tdhBackend) Query(sql string, args ...interface{}) ([]mysql.Row, mysql.Result, error) {
+  return self.mysql.query(sql, args...)
+}
+
+func (self *tdhBackend) Tables() ([]string, error) {
+  return self.mysql.tables()
+}
+
+func (self *tdhBackend) LockDDL(table string, timeout time.Duration) (func(), error) {
+  return self.mysql.lockDDL(table, timeout)
+}
+
+func (self *tdhBackend) SchemaVersions() (map[string]string, error) {
+  return self.mysql.schemaVersions()
+}
+
+func (self *tdhBackend) LoadTable(table string) (*TableInfo, error) {
+  return self.mysql.loadTable(table)
+}
+
+func (self *tdhBackend) CreateTable(table string) error {
+  return self.runDDL(table, func() error {
+    return self.mysql.createTable(table)
+  })
+}
+
+func (self *tdhBackend) AddColumn(table string, column string, t int) error {
+  return self.runDDL(table, func() error {
+    return self.mysql.addColumn(table, column, t)
+  })
+}
+
+func (self *tdhBackend) CreateIndex(table string, index string, columns []string, unique bool) error {
+  return self.runDDL(table, func() error {
+    return self.mysql.createIndex(table, index, columns, unique)
+  })
+}
+
+func (self *tdhBackend) ModifyColumn(table string, column string, t int) error {
+  return self.runDDL(table, func() error {
+    return self.mysql.modifyColumn(table, column, t)
+  })
+}
+
+func (self *tdhBackend) DropIndex(table string, index string) error {
+  return self.runDDL(table, func() error {
+    return self.mysql.dropIndex(table, index)
+  })
+}
+
+func (self *tdhBackend) DropColumn(table string, column string) error {
+  return self.runDDL(table, func() error {
+    return self.mysql.dropColumn(table, column)
+  })
+}
+
+func (self *tdhBackend) RenameColumn(table string, column string, newName string) error {
+  return self.runDDL(table, func() error {
+    return self.mysql.renameColumn(table, column, newName)
+  })
+}
+
+func (self *tdhBackend) DropTable(table string) error {
+  return self.runDDL(table, func() error {
+    return self.mysql.dropTable(table)
+  })
+}
+
+func (self *tdhBackend) withTableCacheOff(table string, fun func() error) error {
+  self.tableCacheVarMutex.Lock()
+  self.tableCacheVarCount++
+  if self.tableCacheVarCount == 1 {
+    _, _, err := self.mysql.query("SET GLOBAL tdh_socket_cache_table_on=0")
+    if err != nil {
+      self.tableCacheVarCount--
+      self.tableCacheVarMutex.Unlock()
+      return &DDLError{table, "SET GLOBAL tdh_socket_cache_table_on=0", fmt.Errorf("need SUPER privilege or another TdhDDL mode: %w", err)}
+    }
+  }
+  self.tableCacheVarMutex.Unlock()
+  defer func() {
+    self.tableCacheVarMutex.Lock()
+    self.tableCacheVarCount--
+    if self.tableCacheVarCount == 0 {
+      self.mysql.query("SET GLOBAL tdh_socket_cache_table_on=1")
+    }
+    self.tableCacheVarMutex.Unlock()
+  }()
+  return fun()
+}
+
+func (self *tdhBackend) withTableFlushed(table string, fun func() error) error {
+  if err := fun(); err != nil {
+    return err
+  }
+  return self.mysql.exec(table, "FLUSH TABLES " + quoteName(table))
+}
+
+func forbidDDL(table string, fun func() error) error {
+  return fmt.Errorf("%w: table %s", ErrDDLForbidden, table)
+}
+
+type tdhConn struct {
+  backend *tdhBackend
+  conn *tdh.Conn
+  isBatch bool // requests queued and not committed yet
+}
+
+func (self *tdhConn) Get(table string, index string, fields []string,
+key [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter) ([][][]byte, []uint8, error) {
+  return self.conn.Get(self.backend.dbname, table, index, fields,
+    key, op, start, limit, filters)
+}
+
+func (self *tdhConn) Insert(table string, index string, fields []string, values []string) error {
+  return wrapTdhError(self.conn.Insert(self.backend.dbname, table, index, fields, values))
+}
+
+func (self *tdhConn) Update(table string, index string, fields []string,
+key [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter, values []string) (int, int, error) {
+  count, change, err := self.conn.Update(self.backend.dbname, table, index, fields,
+    key, op, start, limit, filters, values)
+  return count, change, wrapTdhError(err)
+}
+
+func (self *tdhConn) Delete(table string, index string, fields []string,
+key [][]string, op uint8,
+start uint32, limit uint32, filters []tdh.Filter) (int, error) {
+  return self.conn.Delete(self.backend.dbname, table, index, fields,
+    key, op, start, limit, filters)
+}
+
+func (self *tdhConn) Batch() {
+  self.isBatch = true
+  self.conn.Batch()
+}
+
+func (self *tdhConn) Commit() ([]Result, error) {
+  res, err := self.conn.Commit()
+  if err != nil { // a failed request fails the whole batch
+    // the socket may be left in batch mode, so it is replaced for requests after, like hash collision checks
+    if socket, e := self.backend.dial(); e == nil {
+      self.conn.Close()
+      self.conn = socket
+      self.isBatch = false
+    }
+    return nil, wrapTdhError(err)
+  }
+  self.isBatch = false
+  ret := make([]Result, len(res))
+  for i, r := range res {
+    switch r.T {
+    case tdh.INSERT:
+      ret[i] = Result{INSERT, r.Change, r.Count, wrapTdhError(r.Err)}
+    case tdh.UPDATE:
+      ret[i] = Result{UPDATE, r.Change, r.Count, wrapTdhError(r.Err)}
+    case tdh.DELETE:
+      ret[i] = Result{DELETE, r.Change, r.Count, wrapTdhError(r.Err)}
+    }
+  }
+  return ret, nil
+}
+
+// Release does not pool a socket left in batch mode, by a done context or a failed Commit, for its queued requests would be sent by the next cursor
+func (self *tdhConn) Release() {
+  if self.isBatch {
+    self.backend.replaceSocket(self.conn)
+    return
+  }
+  self.backend.releaseSocket(self.conn)
+}
+
+// wrapTdhError marks tdh duplicate key errors with ErrDuplicateKey
+func wrapTdhError(err error) error {
+  if e, ok := err.(*tdh.Error); ok && e.ClientStatus == tdh.CLIENT_STATUS_DB_ERROR && e.ErrorCode == 121 {
+    return &duplicateKeyError{err}
+  }
+  return err
+}
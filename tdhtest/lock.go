@@ -0,0 +1,73 @@
+package tdhtest
+
+import (
+  "sync"
+  "time"
+)
+
+// namedLocks are the locks of GET_LOCK and RELEASE_LOCK, owned by MySQL connections
+type namedLocks struct {
+  mutex sync.Mutex
+  owners map[string]*mysqlConn
+  released map[string]chan struct{} // closed when the lock is released
+}
+
+func newNamedLocks() *namedLocks {
+  return &namedLocks{
+    owners: make(map[string]*mysqlConn),
+    released: make(map[string]chan struct{}),
+  }
+}
+
+// get waits for the lock no longer than timeout, negative timeout means forever
+func (self *namedLocks) get(name string, owner *mysqlConn, timeout time.Duration) bool {
+  var deadline <-chan time.Time
+  if timeout >= 0 {
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    deadline = timer.C
+  }
+  for {
+    self.mutex.Lock()
+    current, held := self.owners[name]
+    if !held {
+      self.owners[name] = owner
+      self.released[name] = make(chan struct{})
+    }
+    if !held || current == owner {
+      self.mutex.Unlock()
+      return true
+    }
+    released := self.released[name]
+    self.mutex.Unlock()
+    select {
+    case <-released:
+    case <-deadline:
+      return false
+    }
+  }
+}
+
+func (self *namedLocks) release(name string, owner *mysqlConn) bool {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  if self.owners[name] != owner {
+    return false
+  }
+  delete(self.owners, name)
+  close(self.released[name])
+  delete(self.released, name)
+  return true
+}
+
+func (self *namedLocks) releaseAll(owner *mysqlConn) {
+  self.mutex.Lock()
+  defer self.mutex.Unlock()
+  for name, current := range self.owners {
+    if current == owner {
+      delete(self.owners, name)
+      close(self.released[name])
+      delete(self.released, name)
+    }
+  }
+}
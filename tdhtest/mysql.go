@@ -0,0 +1,507 @@
+package tdhtest
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "hash/crc32"
+  "io"
+  "net"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+
+  "github.com/reusee/handa/memstore"
+)
+
+// MySQL commands
+const (
+  comQuit = 0x01
+  comInitDB = 0x02
+  comQuery = 0x03
+  comPing = 0x0e
+)
+
+// MySQL capabilities announced in handshake
+const (
+  clientLongPassword = 0x0001
+  clientLongFlag = 0x0004
+  clientConnectWithDB = 0x0008
+  clientProtocol41 = 0x0200
+  clientTransactions = 0x2000
+  clientSecureConnection = 0x8000
+)
+
+const (
+  charsetUTF8 = 33
+  serverStatusAutocommit = 0x0002
+)
+
+// mysqlError is sent to the client as an error packet
+type mysqlError struct {
+  code uint16
+  state string
+  msg string
+}
+
+func (self *mysqlError) Error() string {
+  return fmt.Sprintf("%d (%s): %s", self.code, self.state, self.msg)
+}
+
+func toMysqlError(err error) *mysqlError {
+  var e *mysqlError
+  switch {
+  case errors.As(err, &e):
+    return e
+  case errors.Is(err, memstore.ErrTableExists):
+    return &mysqlError{1050, "42S01", err.Error()}
+  case errors.Is(err, memstore.ErrNoTable):
+    return &mysqlError{1146, "42S02", err.Error()}
+  case errors.Is(err, memstore.ErrColumnExists):
+    return &mysqlError{1060, "42S21", err.Error()}
+  case errors.Is(err, memstore.ErrIndexExists):
+    return &mysqlError{1061, "42000", err.Error()}
+  case errors.Is(err, memstore.ErrNoColumn):
+    return &mysqlError{1072, "42000", err.Error()}
+  case errors.Is(err, memstore.ErrDuplicate):
+    return &mysqlError{1062, "23000", err.Error()}
+  }
+  return &mysqlError{1105, "HY000", err.Error()}
+}
+
+// mysqlConn is a client connection of the fake MySQL server
+type mysqlConn struct {
+  server *Server
+  r *bufio.Reader
+  w *bufio.Writer
+  seq byte
+}
+
+func (self *Server) serveMysql(conn net.Conn) {
+  c := &mysqlConn{
+    server: self,
+    r: bufio.NewReader(conn),
+    w: bufio.NewWriter(conn),
+  }
+  defer self.locks.releaseAll(c)
+  c.handshake()
+  if _, err := c.readPacket(); err != nil { // authentication, anyone is accepted
+    return
+  }
+  c.writeOK(0, "")
+  if c.w.Flush() != nil {
+    return
+  }
+  for {
+    c.seq = 0
+    packet, err := c.readPacket()
+    if err != nil || len(packet) == 0 {
+      return
+    }
+    switch packet[0] {
+    case comQuit:
+      return
+    case comPing, comInitDB:
+      c.writeOK(0, "")
+    case comQuery:
+      c.query(string(packet[1:]))
+    default:
+      c.writeError(&mysqlError{1047, "08S01", "unknown command"})
+    }
+    if c.w.Flush() != nil {
+      return
+    }
+  }
+}
+
+func (self *mysqlConn) readPacket() ([]byte, error) {
+  var header [4]byte
+  if _, err := io.ReadFull(self.r, header[:]); err != nil {
+    return nil, err
+  }
+  length := int(header[0]) | int(header[1]) << 8 | int(header[2]) << 16
+  self.seq = header[3] + 1
+  packet := make([]byte, length)
+  _, err := io.ReadFull(self.r, packet)
+  return packet, err
+}
+
+func (self *mysqlConn) writePacket(packet []byte) {
+  length := len(packet)
+  self.w.Write([]byte{byte(length), byte(length >> 8), byte(length >> 16), self.seq})
+  self.w.Write(packet)
+  self.seq++
+}
+
+func (self *mysqlConn) handshake() {
+  caps := clientLongPassword | clientLongFlag | clientConnectWithDB | clientProtocol41 |
+    clientTransactions | clientSecureConnection
+  p := []byte{10}
+  p = append(p, "5.5.0-tdhtest"...)
+  p = append(p, 0)
+  p = append(p, 1, 0, 0, 0) // connection id
+  p = append(p, "12345678"...) // scramble
+  p = append(p, 0)
+  p = append(p, byte(caps), byte(caps >> 8))
+  p = append(p, charsetUTF8)
+  p = append(p, serverStatusAutocommit, 0)
+  p = append(p, 0, 0) // upper capabilities
+  p = append(p, 21)
+  p = append(p, make([]byte, 10)...)
+  p = append(p, "123456789012"...) // scramble
+  p = append(p, 0)
+  self.seq = 0
+  self.writePacket(p)
+  self.w.Flush()
+}
+
+func (self *mysqlConn) writeOK(affectedRows int, message string) {
+  p := []byte{0}
+  p = appendLengthEncodedInt(p, uint64(affectedRows))
+  p = appendLengthEncodedInt(p, 0)
+  p = append(p, serverStatusAutocommit, 0, 0, 0)
+  p = append(p, message...)
+  self.writePacket(p)
+}
+
+func (self *mysqlConn) writeError(err *mysqlError) {
+  p := []byte{0xff, byte(err.code), byte(err.code >> 8), '#'}
+  p = append(p, err.state...)
+  p = append(p, err.msg...)
+  self.writePacket(p)
+}
+
+func (self *mysqlConn) writeEOF() {
+  self.writePacket([]byte{0xfe, 0, 0, serverStatusAutocommit, 0})
+}
+
+// writeRows sends a text protocol result set of string columns
+func (self *mysqlConn) writeRows(columns []string, rows [][]string) {
+  self.writePacket(appendLengthEncodedInt(nil, uint64(len(columns))))
+  for _, column := range columns {
+    var p []byte
+    for _, s := range []string{"def", "", "", "", column, column} {
+      p = appendLengthEncodedString(p, s)
+    }
+    p = append(p, 0x0c, charsetUTF8, 0)
+    p = append(p, 0, 1, 0, 0) // display length
+    p = append(p, mysqlTypeVarString)
+    p = append(p, 0, 0, 0, 0, 0)
+    self.writePacket(p)
+  }
+  self.writeEOF()
+  for _, row := range rows {
+    var p []byte
+    for _, value := range row {
+      p = appendLengthEncodedString(p, value)
+    }
+    self.writePacket(p)
+  }
+  self.writeEOF()
+}
+
+func appendLengthEncodedInt(p []byte, n uint64) []byte {
+  switch {
+  case n < 251:
+    return append(p, byte(n))
+  case n < 1 << 16:
+    return append(p, 0xfc, byte(n), byte(n >> 8))
+  case n < 1 << 24:
+    return append(p, 0xfd, byte(n), byte(n >> 8), byte(n >> 16))
+  }
+  p = append(p, 0xfe)
+  for i := uint(0); i < 8; i++ {
+    p = append(p, byte(n >> (i * 8)))
+  }
+  return p
+}
+
+func appendLengthEncodedString(p []byte, s string) []byte {
+  return append(appendLengthEncodedInt(p, uint64(len(s))), s...)
+}
+
+var (
+  setPattern = regexp.MustCompile(`(?i)^set\s`)
+  flushPattern = regexp.MustCompile(`(?i)^flush\s+tables?(\s|$)`)
+  showTablesPattern = regexp.MustCompile(`(?i)^show\s+tables$`)
+  describePattern = regexp.MustCompile(`(?i)^(?:describe|desc)\s+(\S+)$`)
+  showIndexesPattern = regexp.MustCompile(`(?i)^show\s+(?:index|indexes|keys)\s+(?:in|from)\s+(\S+)$`)
+  showCreateTablePattern = regexp.MustCompile(`(?i)^show\s+create\s+table\s+(\S+)$`)
+  createTablePattern = regexp.MustCompile(`(?is)^create\s+table\s+(if\s+not\s+exists\s+)?(\S+)\s*\(.*\)`)
+  addColumnPattern = regexp.MustCompile(`(?i)^alter\s+table\s+(\S+)\s+add\s+\(?\s*(\S+)\s+(.+?)\s+(?:not\s+)?null\s+default\s+(.+?)\s*\)?$`)
+  modifyColumnPattern = regexp.MustCompile(`(?i)^alter\s+table\s+(\S+)\s+modify\s+(?:column\s+)?(\S+)\s+(.+?)\s+(?:not\s+)?null\s+default\s+(.+?)$`)
+  dropColumnPattern = regexp.MustCompile(`(?i)^alter\s+table\s+(\S+)\s+drop\s+(?:column\s+)?(\S+)$`)
+  changeColumnPattern = regexp.MustCompile(`(?i)^alter\s+table\s+(\S+)\s+change\s+(?:column\s+)?(\S+)\s+(\S+)\s+.+$`) // definition is kept
+  dropTablePattern = regexp.MustCompile(`(?i)^drop\s+table\s+(if\s+exists\s+)?(\S+)$`)
+  dropIndexPattern = regexp.MustCompile(`(?i)^drop\s+index\s+(\S+)\s+on\s+(\S+)$`)
+  createIndexPattern = regexp.MustCompile(`(?i)^create\s+(unique\s+)?index\s+(\S+)\s+on\s+(\S+)\s*\((.+)\)$`)
+  countPattern = regexp.MustCompile(`(?i)^select\s+count\(\*\)\s+from\s+(\S+)$`)
+  getLockPattern = regexp.MustCompile(`(?i)^select\s+get_lock\('((?:[^'\\]|\\.)*)',\s*(-?\d+)\)$`)
+  releaseLockPattern = regexp.MustCompile(`(?i)^select\s+release_lock\('((?:[^'\\]|\\.)*)'\)$`)
+  schemaVersionPattern = regexp.MustCompile(`(?is)^select\s+table_name,.*\s+from\s+information_schema\.(columns|statistics)\s.*group\s+by\s+table_name$`)
+)
+
+// unquote strips backquotes of a name, or single quotes of a value. NULL becomes empty string.
+func unquote(s string) string {
+  s = strings.TrimSpace(s)
+  if strings.EqualFold(s, "NULL") {
+    return ""
+  }
+  if len(s) >= 2 && s[0] == '`' && s[len(s) - 1] == '`' {
+    return strings.ReplaceAll(s[1:len(s) - 1], "``", "`")
+  }
+  if len(s) >= 2 && s[0] == '\'' && s[len(s) - 1] == '\'' {
+    return s[1:len(s) - 1]
+  }
+  return s
+}
+
+// quote quotes a name with backquotes, as SHOW CREATE TABLE does
+func quote(name string) string {
+  return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// unescape removes backslash escapes of a string literal
+func unescape(s string) string {
+  var b strings.Builder
+  for i := 0; i < len(s); i++ {
+    if s[i] == '\\' && i + 1 < len(s) {
+      i++
+    }
+    b.WriteByte(s[i])
+  }
+  return b.String()
+}
+
+func (self *mysqlConn) query(sql string) {
+  sql = strings.TrimRight(strings.TrimSpace(sql), ";")
+  store := self.server.Store
+  var columns []string
+  var rows [][]string
+  var err error
+  switch {
+  case setPattern.MatchString(sql), flushPattern.MatchString(sql):
+
+  case showTablesPattern.MatchString(sql):
+    columns = []string{"Tables_in_" + self.server.Database}
+    err = store.Do(func(tx *memstore.Tx) error {
+      for _, table := range tx.Tables() {
+        rows = append(rows, []string{table})
+      }
+      return nil
+    })
+
+  case describePattern.MatchString(sql):
+    table := unquote(describePattern.FindStringSubmatch(sql)[1])
+    columns = []string{"Field", "Type", "Null", "Key", "Default", "Extra"}
+    err = store.Do(func(tx *memstore.Tx) error {
+      cols, err := tx.Columns(table)
+      if err != nil {
+        return err
+      }
+      for _, col := range cols {
+        if col.Name == "serial" {
+          rows = append(rows, []string{col.Name, col.Type, "NO", "PRI", "", "auto_increment"})
+        } else {
+          rows = append(rows, []string{col.Name, col.Type, "YES", "", col.Default, ""})
+        }
+      }
+      return nil
+    })
+
+  case showIndexesPattern.MatchString(sql):
+    table := unquote(showIndexesPattern.FindStringSubmatch(sql)[1])
+    columns = []string{"Table", "Non_unique", "Key_name", "Seq_in_index", "Column_name", "Index_type"}
+    err = store.Do(func(tx *memstore.Tx) error {
+      indexes, err := tx.Indexes(table)
+      if err != nil {
+        return err
+      }
+      for _, index := range indexes {
+        nonUnique := "1"
+        if index.Unique {
+          nonUnique = "0"
+        }
+        for i, column := range index.Columns {
+          rows = append(rows, []string{table, nonUnique, index.Name, strconv.Itoa(i + 1), column, "BTREE"})
+        }
+      }
+      return nil
+    })
+
+  case showCreateTablePattern.MatchString(sql):
+    table := unquote(showCreateTablePattern.FindStringSubmatch(sql)[1])
+    columns = []string{"Table", "Create Table"}
+    err = store.Do(func(tx *memstore.Tx) error {
+      cols, err := tx.Columns(table)
+      if err != nil {
+        return err
+      }
+      indexes, err := tx.Indexes(table)
+      if err != nil {
+        return err
+      }
+      var lines []string
+      for _, col := range cols {
+        if col.Name == "serial" {
+          lines = append(lines, "`serial` bigint(20) unsigned NOT NULL AUTO_INCREMENT")
+        } else {
+          lines = append(lines, fmt.Sprintf("%s %s DEFAULT '%s'", quote(col.Name), col.Type, strings.ReplaceAll(col.Default, "'", "''")))
+        }
+      }
+      for _, index := range indexes {
+        quoted := make([]string, len(index.Columns))
+        for i, column := range index.Columns {
+          quoted[i] = quote(column)
+        }
+        key := "KEY"
+        if index.Unique {
+          key = "UNIQUE KEY"
+        }
+        lines = append(lines, fmt.Sprintf("%s %s (%s)", key, quote(index.Name), strings.Join(quoted, ",")))
+      }
+      rows = append(rows, []string{table, fmt.Sprintf("CREATE TABLE %s (\n  %s\n) ENGINE=InnoDB DEFAULT CHARSET=utf8",
+        quote(table), strings.Join(lines, ",\n  "))})
+      return nil
+    })
+
+  case createTablePattern.MatchString(sql): // column definitions are ignored, tables always start with serial
+    match := createTablePattern.FindStringSubmatch(sql)
+    ifNotExists, table := match[1] != "", unquote(match[2])
+    err = store.Do(func(tx *memstore.Tx) error {
+      err := tx.CreateTable(table)
+      if ifNotExists && errors.Is(err, memstore.ErrTableExists) {
+        return nil
+      }
+      return err
+    })
+
+  case addColumnPattern.MatchString(sql):
+    match := addColumnPattern.FindStringSubmatch(sql)
+    err = store.Do(func(tx *memstore.Tx) error {
+      return tx.AddColumn(unquote(match[1]), unquote(match[2]), match[3], unquote(match[4]))
+    })
+
+  case modifyColumnPattern.MatchString(sql):
+    match := modifyColumnPattern.FindStringSubmatch(sql)
+    err = store.Do(func(tx *memstore.Tx) error {
+      return tx.ModifyColumn(unquote(match[1]), unquote(match[2]), match[3], unquote(match[4]))
+    })
+
+  case dropColumnPattern.MatchString(sql):
+    match := dropColumnPattern.FindStringSubmatch(sql)
+    err = store.Do(func(tx *memstore.Tx) error {
+      return tx.DropColumn(unquote(match[1]), unquote(match[2]))
+    })
+
+  case changeColumnPattern.MatchString(sql):
+    match := changeColumnPattern.FindStringSubmatch(sql)
+    err = store.Do(func(tx *memstore.Tx) error {
+      return tx.RenameColumn(unquote(match[1]), unquote(match[2]), unquote(match[3]))
+    })
+
+  case dropTablePattern.MatchString(sql):
+    match := dropTablePattern.FindStringSubmatch(sql)
+    ifExists, table := match[1] != "", unquote(match[2])
+    err = store.Do(func(tx *memstore.Tx) error {
+      err := tx.DropTable(table)
+      if ifExists && errors.Is(err, memstore.ErrNoTable) {
+        return nil
+      }
+      return err
+    })
+
+  case dropIndexPattern.MatchString(sql):
+    match := dropIndexPattern.FindStringSubmatch(sql)
+    err = store.Do(func(tx *memstore.Tx) error {
+      return tx.DropIndex(unquote(match[2]), unquote(match[1]))
+    })
+
+  case createIndexPattern.MatchString(sql):
+    match := createIndexPattern.FindStringSubmatch(sql)
+    var indexColumns []string
+    for _, column := range strings.Split(match[4], ",") {
+      indexColumns = append(indexColumns, unquote(column))
+    }
+    err = store.Do(func(tx *memstore.Tx) error {
+      return tx.CreateIndex(unquote(match[3]), unquote(match[2]), indexColumns, match[1] != "")
+    })
+
+  case countPattern.MatchString(sql):
+    table := unquote(countPattern.FindStringSubmatch(sql)[1])
+    columns = []string{"COUNT(*)"}
+    err = store.Do(func(tx *memstore.Tx) error {
+      n, err := tx.Count(table)
+      rows = append(rows, []string{strconv.Itoa(n)})
+      return err
+    })
+
+  case getLockPattern.MatchString(sql):
+    match := getLockPattern.FindStringSubmatch(sql)
+    seconds, _ := strconv.Atoi(match[2])
+    columns = []string{"GET_LOCK"}
+    if self.server.locks.get(unescape(match[1]), self, time.Duration(seconds) * time.Second) {
+      rows = append(rows, []string{"1"})
+    } else {
+      rows = append(rows, []string{"0"})
+    }
+
+  case releaseLockPattern.MatchString(sql):
+    columns = []string{"RELEASE_LOCK"}
+    if self.server.locks.release(unescape(releaseLockPattern.FindStringSubmatch(sql)[1]), self) {
+      rows = append(rows, []string{"1"})
+    } else {
+      rows = append(rows, []string{"0"})
+    }
+
+  case schemaVersionPattern.MatchString(sql): // row count and crc32 sum of the columns or indexes of each table
+    isColumns := strings.EqualFold(schemaVersionPattern.FindStringSubmatch(sql)[1], "columns")
+    columns = []string{"TABLE_NAME", "COUNT(*)", "SUM"}
+    err = store.Do(func(tx *memstore.Tx) error {
+      for _, table := range tx.Tables() {
+        var entries []string
+        if isColumns {
+          cols, err := tx.Columns(table)
+          if err != nil {
+            return err
+          }
+          for _, col := range cols {
+            entries = append(entries, col.Name + " " + col.Type)
+          }
+        } else {
+          indexes, err := tx.Indexes(table)
+          if err != nil {
+            return err
+          }
+          for _, index := range indexes {
+            nonUnique := "1"
+            if index.Unique {
+              nonUnique = "0"
+            }
+            for _, column := range index.Columns {
+              entries = append(entries, index.Name + " " + column + " " + nonUnique)
+            }
+          }
+        }
+        var sum uint64
+        for _, entry := range entries {
+          sum += uint64(crc32.ChecksumIEEE([]byte(entry)))
+        }
+        rows = append(rows, []string{table, strconv.Itoa(len(entries)), strconv.FormatUint(sum, 10)})
+      }
+      return nil
+    })
+
+  default:
+    err = &mysqlError{1064, "42000", "tdhtest does not understand " + sql}
+  }
+
+  if err != nil {
+    self.writeError(toMysqlError(err))
+  } else if columns == nil {
+    self.writeOK(0, "")
+  } else {
+    self.writeRows(columns, rows)
+  }
+}
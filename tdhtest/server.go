@@ -0,0 +1,117 @@
+// Package tdhtest runs a fake TDH_Socket server and a fake MySQL server on
+// localhost, both backed by one in-memory store, so that handa's tdh backend
+// can be tested without a patched MySQL.
+//
+// The MySQL side only understands the statements handa issues for schema
+// management (SHOW TABLES, DESCRIBE, SHOW INDEXES, SHOW CREATE TABLE, CREATE TABLE, DROP TABLE,
+// ALTER TABLE ADD, MODIFY, CHANGE and DROP, CREATE INDEX, DROP INDEX, SET,
+// FLUSH TABLES), SELECT COUNT(*) and the
+// information_schema queries handa polls for schema changes, and GET_LOCK and
+// RELEASE_LOCK. Locks are released when their connections close.
+// It accepts any user and password.
+//
+// The TDH_Socket side implements handshake, get, insert, update, delete and batch.
+// Integers are big-endian, strings are sent with their length including a
+// trailing zero byte, and a length of zero stands for NULL.
+package tdhtest
+
+import (
+  "net"
+  "sync"
+
+  "github.com/reusee/handa/memstore"
+)
+
+type Server struct {
+  Store *memstore.Store
+  Database string
+  MysqlPort string
+  TdhPort string
+
+  locks *namedLocks
+
+  mysqlListener net.Listener
+  tdhListener net.Listener
+
+  connsMutex sync.Mutex
+  conns map[net.Conn]bool
+  closed bool
+  wg sync.WaitGroup
+}
+
+// NewServer starts both servers on random ports of 127.0.0.1, serving the database named database
+func NewServer(database string) (*Server, error) {
+  self := &Server{
+    Store: memstore.New(),
+    Database: database,
+    locks: newNamedLocks(),
+    conns: make(map[net.Conn]bool),
+  }
+  var err error
+  self.mysqlListener, err = net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    return nil, err
+  }
+  self.tdhListener, err = net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    self.mysqlListener.Close()
+    return nil, err
+  }
+  _, self.MysqlPort, _ = net.SplitHostPort(self.mysqlListener.Addr().String())
+  _, self.TdhPort, _ = net.SplitHostPort(self.tdhListener.Addr().String())
+  self.wg.Add(2)
+  go self.serve(self.mysqlListener, self.serveMysql)
+  go self.serve(self.tdhListener, self.serveTdh)
+  return self, nil
+}
+
+func (self *Server) serve(listener net.Listener, handle func(net.Conn)) {
+  defer self.wg.Done()
+  for {
+    conn, err := listener.Accept()
+    if err != nil {
+      return
+    }
+    if !self.track(conn) {
+      conn.Close()
+      return
+    }
+    self.wg.Add(1)
+    go func() {
+      defer self.wg.Done()
+      defer self.untrack(conn)
+      handle(conn)
+    }()
+  }
+}
+
+func (self *Server) track(conn net.Conn) bool {
+  self.connsMutex.Lock()
+  defer self.connsMutex.Unlock()
+  if self.closed {
+    return false
+  }
+  self.conns[conn] = true
+  return true
+}
+
+func (self *Server) untrack(conn net.Conn) {
+  self.connsMutex.Lock()
+  defer self.connsMutex.Unlock()
+  delete(self.conns, conn)
+  conn.Close()
+}
+
+// Close stops both servers and closes all client connections
+func (self *Server) Close() error {
+  self.connsMutex.Lock()
+  self.closed = true
+  for conn := range self.conns {
+    conn.Close()
+  }
+  self.connsMutex.Unlock()
+  self.mysqlListener.Close()
+  self.tdhListener.Close()
+  self.wg.Wait()
+  return nil
+}
@@ -0,0 +1,471 @@
+package tdhtest
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "strconv"
+  "strings"
+
+  tdh "github.com/reusee/go-tdhsocket"
+  "github.com/reusee/handa/memstore"
+)
+
+const (
+  tdhMagic = 0xffffffff
+  tdhHeaderLength = 20
+)
+
+// request types
+const (
+  requestGet = 0
+  requestUpdate = 10
+  requestDelete = 11
+  requestInsert = 12
+  requestBatch = 20
+  requestShakeHands = 0xffff
+)
+
+// response status
+const (
+  statusOK = 200
+  statusBadRequest = 400
+  statusNotFound = 404
+  statusNotImplemented = 501
+  statusDBError = 502
+)
+
+// error codes sent along with status other than statusOK
+const (
+  errorCodeOpenTable = 1
+  errorCodeOpenIndex = 2
+  errorCodeMissingField = 3
+  errorCodeDecodeRequest = 7
+  errorCodeNotImplemented = 10
+  errorCodeDuplicateKey = 121 // HA_ERR_FOUND_DUPP_KEY
+)
+
+const updateSet = 0
+
+type tdhHeader struct {
+  command uint32 // or status in responses
+  seq uint32
+  reserved uint32
+  length uint32
+}
+
+// tdhError is a failed request, sent back as status and error code
+type tdhError struct {
+  status uint32
+  code uint32
+  err error
+}
+
+func (self *tdhError) Error() string {
+  return fmt.Sprintf("tdh status %d code %d: %v", self.status, self.code, self.err)
+}
+
+func (self *Server) serveTdh(conn net.Conn) {
+  r := bufio.NewReader(conn)
+  w := bufio.NewWriter(conn)
+  for {
+    header, body, err := readTdhPacket(r)
+    if err != nil {
+      return
+    }
+    if header.command == requestShakeHands { // no response
+      if _, err := decodeShakeHands(body); err != nil {
+        return
+      }
+      continue
+    }
+    writeTdhPacket(w, self.handleTdh(header, body))
+    if err := w.Flush(); err != nil {
+      return
+    }
+  }
+}
+
+func readTdhPacket(r io.Reader) (header tdhHeader, body []byte, err error) {
+  buf := make([]byte, tdhHeaderLength)
+  if _, err = io.ReadFull(r, buf); err != nil {
+    return
+  }
+  if binary.BigEndian.Uint32(buf) != tdhMagic {
+    err = errors.New("bad magic code")
+    return
+  }
+  header.command = binary.BigEndian.Uint32(buf[4:])
+  header.seq = binary.BigEndian.Uint32(buf[8:])
+  header.reserved = binary.BigEndian.Uint32(buf[12:])
+  header.length = binary.BigEndian.Uint32(buf[16:])
+  body = make([]byte, header.length)
+  _, err = io.ReadFull(r, body)
+  return
+}
+
+type tdhPacket struct {
+  header tdhHeader
+  body []byte
+}
+
+func writeTdhPacket(w io.Writer, packet tdhPacket) error {
+  buf := make([]byte, tdhHeaderLength, tdhHeaderLength + len(packet.body))
+  binary.BigEndian.PutUint32(buf, tdhMagic)
+  binary.BigEndian.PutUint32(buf[4:], packet.header.command)
+  binary.BigEndian.PutUint32(buf[8:], packet.header.seq)
+  binary.BigEndian.PutUint32(buf[12:], packet.header.reserved)
+  binary.BigEndian.PutUint32(buf[16:], uint32(len(packet.body)))
+  _, err := w.Write(append(buf, packet.body...))
+  return err
+}
+
+func errorPacket(seq uint32, err error) tdhPacket {
+  var e *tdhError
+  if !errors.As(err, &e) {
+    e = toTdhError(err)
+  }
+  body := make([]byte, 4)
+  binary.BigEndian.PutUint32(body, e.code)
+  return tdhPacket{tdhHeader{command: e.status, seq: seq}, body}
+}
+
+func toTdhError(err error) *tdhError {
+  switch {
+  case errors.Is(err, memstore.ErrDuplicate):
+    return &tdhError{statusDBError, errorCodeDuplicateKey, err}
+  case errors.Is(err, memstore.ErrNoTable):
+    return &tdhError{statusNotFound, errorCodeOpenTable, err}
+  case errors.Is(err, memstore.ErrNoIndex):
+    return &tdhError{statusNotFound, errorCodeOpenIndex, err}
+  case errors.Is(err, memstore.ErrNoColumn):
+    return &tdhError{statusNotFound, errorCodeMissingField, err}
+  }
+  return &tdhError{statusBadRequest, errorCodeDecodeRequest, err}
+}
+
+// handleTdh runs a request, or all requests of a batch in one transaction
+func (self *Server) handleTdh(header tdhHeader, body []byte) tdhPacket {
+  if header.command != requestBatch {
+    var response []byte
+    err := self.Store.Do(func(tx *memstore.Tx) (err error) {
+      response, err = self.execTdh(tx, header.command, body)
+      return
+    })
+    if err != nil {
+      return errorPacket(header.seq, err)
+    }
+    return tdhPacket{tdhHeader{command: statusOK, seq: header.seq}, response}
+  }
+
+  r := bytes.NewReader(body)
+  var requests []tdhPacket
+  for i := uint32(0); i < header.reserved; i++ {
+    subHeader, subBody, err := readTdhPacket(r)
+    if err != nil {
+      return errorPacket(header.seq, err)
+    }
+    requests = append(requests, tdhPacket{subHeader, subBody})
+  }
+  buf := new(bytes.Buffer)
+  err := self.Store.Atomic(func(tx *memstore.Tx) error {
+    for _, request := range requests {
+      response, err := self.execTdh(tx, request.header.command, request.body)
+      if err != nil {
+        return err
+      }
+      writeTdhPacket(buf, tdhPacket{tdhHeader{command: statusOK, seq: request.header.seq}, response})
+    }
+    return nil
+  })
+  if err != nil {
+    return errorPacket(header.seq, err)
+  }
+  return tdhPacket{tdhHeader{command: statusOK, seq: header.seq, reserved: uint32(len(requests))}, buf.Bytes()}
+}
+
+func (self *Server) execTdh(tx *memstore.Tx, command uint32, body []byte) ([]byte, error) {
+  d := &decoder{body: body}
+  switch command {
+  case requestGet:
+    req := d.getRequest()
+    if d.err != nil {
+      return nil, d.err
+    }
+    if err := self.checkDatabase(req.db); err != nil {
+      return nil, err
+    }
+    rows, err := tx.Get(req.table, req.index, req.fields, req.keys, req.op, req.start, req.limit, req.filters)
+    if err != nil {
+      return nil, err
+    }
+    columns, err := tx.Columns(req.table)
+    if err != nil {
+      return nil, err
+    }
+    types := make(map[string]string)
+    for _, column := range columns {
+      types[column.Name] = column.Type
+    }
+    e := new(encoder)
+    e.uint32(uint32(len(req.fields)))
+    for _, field := range req.fields {
+      e.byte(fieldType(types[field]))
+    }
+    for _, row := range rows {
+      for _, value := range row {
+        e.string(value)
+      }
+    }
+    return e.bytes(), nil
+
+  case requestUpdate, requestDelete:
+    req := d.getRequest()
+    var values []string
+    if command == requestUpdate {
+      n := d.uint32()
+      for i := uint32(0); i < n && d.err == nil; i++ {
+        if d.byte() != updateSet {
+          return nil, &tdhError{statusNotImplemented, errorCodeNotImplemented, errors.New("only set is supported")}
+        }
+        values = append(values, d.string())
+      }
+    }
+    if d.err != nil {
+      return nil, d.err
+    }
+    if err := self.checkDatabase(req.db); err != nil {
+      return nil, err
+    }
+    var count, change int
+    var err error
+    if command == requestUpdate {
+      count, change, err = tx.Update(req.table, req.index, req.fields, req.keys, req.op, req.start, req.limit, req.filters, values)
+    } else {
+      change, err = tx.Delete(req.table, req.index, req.keys, req.op, req.start, req.limit, req.filters)
+      count = change
+    }
+    if err != nil {
+      return nil, err
+    }
+    return resultRecord(strconv.Itoa(count), strconv.Itoa(change)), nil
+
+  case requestInsert:
+    db, table, _, fields := d.string(), d.string(), d.string(), d.strings()
+    n := d.uint32()
+    var values []string
+    for i := uint32(0); i < n && d.err == nil; i++ {
+      d.byte() // update flag, meaningless for insert
+      values = append(values, d.string())
+    }
+    if d.err != nil {
+      return nil, d.err
+    }
+    if len(values) != len(fields) {
+      return nil, &tdhError{statusBadRequest, errorCodeDecodeRequest, errors.New("field and value count mismatch")}
+    }
+    if err := self.checkDatabase(db); err != nil {
+      return nil, err
+    }
+    // index columns may appear twice in fields, the first one is kept
+    seen := make(map[string]bool)
+    var fs, vs []string
+    for i, field := range fields {
+      if !seen[field] {
+        seen[field] = true
+        fs = append(fs, field)
+        vs = append(vs, values[i])
+      }
+    }
+    if err := tx.Insert(table, fs, vs); err != nil {
+      return nil, err
+    }
+    rows, err := tx.Get(table, "serial", []string{"serial"}, [][]string{{"18446744073709551615"}}, tdh.LE, 0, 1, nil)
+    if err != nil || len(rows) == 0 {
+      return resultRecord("0"), nil
+    }
+    return resultRecord(rows[0][0]), nil
+  }
+
+  return nil, &tdhError{statusNotImplemented, errorCodeNotImplemented, fmt.Errorf("unknown request type %d", command)}
+}
+
+func (self *Server) checkDatabase(db string) error {
+  if db != self.Database {
+    return &tdhError{statusNotFound, errorCodeOpenTable, fmt.Errorf("unknown database %s", db)}
+  }
+  return nil
+}
+
+// resultRecord encodes a response of one record with numeric fields
+func resultRecord(values ...string) []byte {
+  e := new(encoder)
+  e.uint32(uint32(len(values)))
+  for range values {
+    e.byte(mysqlTypeLongLong)
+  }
+  for _, value := range values {
+    e.string(value)
+  }
+  return e.bytes()
+}
+
+// MySQL field types
+const (
+  mysqlTypeTiny = 1
+  mysqlTypeDouble = 5
+  mysqlTypeLongLong = 8
+  mysqlTypeVarchar = 15
+  mysqlTypeBlob = 252
+  mysqlTypeVarString = 253
+  mysqlTypeString = 254
+)
+
+func fieldType(t string) uint8 {
+  switch {
+  case strings.HasPrefix(t, "tinyint"):
+    return mysqlTypeTiny
+  case strings.HasPrefix(t, "bigint"):
+    return mysqlTypeLongLong
+  case strings.HasPrefix(t, "double"):
+    return mysqlTypeDouble
+  case strings.HasPrefix(t, "varchar"):
+    return mysqlTypeVarchar
+  case strings.HasPrefix(t, "char"):
+    return mysqlTypeString
+  case strings.HasSuffix(t, "text"), strings.HasSuffix(t, "blob"):
+    return mysqlTypeBlob
+  }
+  return mysqlTypeVarString
+}
+
+type getRequest struct {
+  db, table, index string
+  fields []string
+  op uint8
+  keys [][]string
+  start, limit uint32
+  filters []tdh.Filter
+}
+
+func (self *decoder) getRequest() (req getRequest) {
+  req.db = self.string()
+  req.table = self.string()
+  req.index = self.string()
+  req.fields = self.strings()
+  req.op = self.byte()
+  n := self.uint32()
+  for i := uint32(0); i < n && self.err == nil; i++ {
+    req.keys = append(req.keys, self.strings())
+  }
+  req.start = self.uint32()
+  req.limit = self.uint32()
+  n = self.uint32()
+  for i := uint32(0); i < n && self.err == nil; i++ {
+    var filter tdh.Filter
+    filter.Field = self.string()
+    filter.Op = self.byte()
+    filter.Value = self.string()
+    req.filters = append(req.filters, filter)
+  }
+  return
+}
+
+type shakeHands struct {
+  version, timeout uint32
+  readCode, writeCode string
+}
+
+func decodeShakeHands(body []byte) (ret shakeHands, err error) {
+  d := &decoder{body: body}
+  if magic := string(d.take(4)); d.err == nil && magic != "TDHS" {
+    return ret, errors.New("bad shake hands")
+  }
+  ret.version = d.uint32()
+  ret.timeout = d.uint32()
+  ret.readCode = d.string()
+  ret.writeCode = d.string()
+  return ret, d.err
+}
+
+// decoder reads fields of a request body, the first error is kept in err
+type decoder struct {
+  body []byte
+  err error
+}
+
+func (self *decoder) take(n int) []byte {
+  if self.err != nil {
+    return nil
+  }
+  if n > len(self.body) {
+    self.err = &tdhError{statusBadRequest, errorCodeDecodeRequest, errors.New("short request")}
+    return nil
+  }
+  ret := self.body[:n]
+  self.body = self.body[n:]
+  return ret
+}
+
+func (self *decoder) byte() uint8 {
+  b := self.take(1)
+  if b == nil {
+    return 0
+  }
+  return b[0]
+}
+
+func (self *decoder) uint32() uint32 {
+  b := self.take(4)
+  if b == nil {
+    return 0
+  }
+  return binary.BigEndian.Uint32(b)
+}
+
+func (self *decoder) string() string {
+  n := self.uint32()
+  if n == 0 { // NULL
+    return ""
+  }
+  b := self.take(int(n))
+  if b == nil {
+    return ""
+  }
+  return string(b[:n - 1])
+}
+
+func (self *decoder) strings() (ret []string) {
+  n := self.uint32()
+  for i := uint32(0); i < n && self.err == nil; i++ {
+    ret = append(ret, self.string())
+  }
+  return
+}
+
+type encoder struct {
+  buf []byte
+}
+
+func (self *encoder) byte(b uint8) {
+  self.buf = append(self.buf, b)
+}
+
+func (self *encoder) uint32(n uint32) {
+  var b [4]byte
+  binary.BigEndian.PutUint32(b[:], n)
+  self.buf = append(self.buf, b[:]...)
+}
+
+func (self *encoder) string(s string) {
+  self.uint32(uint32(len(s) + 1))
+  self.buf = append(append(self.buf, s...), 0)
+}
+
+func (self *encoder) bytes() []byte {
+  return self.buf
+}